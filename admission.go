@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var extractions = &admission{
+	maxInFlight:  64,
+	maxQueue:     128,
+	queueTimeout: 10 * time.Second,
+	retryAfter:   1 * time.Second,
+}
+
+type admissionStats struct {
+	InFlight int
+	Queued   int
+	Admitted int64
+	Rejected int64
+	TimedOut int64
+	// Abandoned counts the requests whose client went away or whose
+	// deadline passed before they were admitted.
+	Abandoned int64
+}
+
+// admission limits the number of requests handled at once. Requests over
+// the limit wait in a bounded FIFO queue; those finding the queue full or
+// waiting longer than the queue timeout are shed.
+type admission struct {
+	maxInFlight  int
+	maxQueue     int
+	queueTimeout time.Duration
+	retryAfter   time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  []chan struct{}
+	stats    admissionStats
+}
+
+// acquire returns whether the request was admitted. Admitted requests must
+// call release when done. A request whose context ends while it waits
+// leaves the queue right away.
+func (a *admission) acquire(ctx context.Context) bool {
+	a.mu.Lock()
+	if ctx.Err() != nil {
+		a.stats.Abandoned++
+		a.mu.Unlock()
+		return false
+	}
+	if a.maxInFlight <= 0 || a.inFlight < a.maxInFlight {
+		a.inFlight++
+		a.stats.Admitted++
+		a.mu.Unlock()
+		return true
+	}
+	if len(a.waiters) >= a.maxQueue {
+		a.stats.Rejected++
+		a.mu.Unlock()
+		return false
+	}
+	turn := make(chan struct{})
+	a.waiters = append(a.waiters, turn)
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.queueTimeout)
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case <-turn:
+		return true
+	case <-timer.C:
+		timedOut = true
+	case <-ctx.Done():
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, w := range a.waiters {
+		if w == turn {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			if timedOut {
+				a.stats.TimedOut++
+			} else {
+				a.stats.Abandoned++
+			}
+			return false
+		}
+	}
+	// The slot was handed over while the timer fired or the context ended.
+	return true
+}
+
+// release hands the slot of a finished request to the longest waiting one.
+func (a *admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.waiters) > 0 {
+		turn := a.waiters[0]
+		a.waiters = a.waiters[1:]
+		a.stats.Admitted++
+		close(turn)
+		return
+	}
+	a.inFlight--
+}
+
+func (a *admission) currentStats() admissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := a.stats
+	stats.InFlight = a.inFlight
+	stats.Queued = len(a.waiters)
+	return stats
+}
+
+// limitConcurrency sheds requests with 503 when too many are in flight. The
+// context of admitted requests ends shortly before the write timeout,
+// counted from their arrival, so that fetches give up while the response
+// can still be written.
+func limitConcurrency(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if timeout := serverSettings.writeTimeout; timeout > 0 {
+			// A tenth of the write timeout is left for extracting and
+			// writing the result.
+			ctx, cancel := context.WithTimeout(req.Context(), timeout-timeout/10)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		if !extractions.acquire(req.Context()) {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(extractions.retryAfter.Seconds())))
+			format, _ := negotiateFormat(req)
+			writeResult(writer, format, http.StatusServiceUnavailable, result{
+				Error:     fmt.Sprintf("Too many requests in flight, retry in %v.", extractions.retryAfter),
+				ErrorCode: "overloaded",
+			})
+			return
+		}
+		defer extractions.release()
+		handler(writer, req)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionQueuesAndSheds(t *testing.T) {
+	a := &admission{maxInFlight: 1, maxQueue: 1, queueTimeout: time.Minute}
+
+	if !a.acquire(context.Background()) {
+		t.Fatalf("Expected the first request to be admitted")
+	}
+	queued := make(chan bool)
+	go func() { queued <- a.acquire(context.Background()) }()
+	waitFor(t, func() bool { return a.currentStats().Queued == 1 })
+
+	if a.acquire(context.Background()) {
+		t.Errorf("Expected a request finding the queue full to be shed")
+	}
+	a.release()
+	if !<-queued {
+		t.Errorf("Expected the queued request to be admitted after release")
+	}
+	a.release()
+
+	if stats := a.currentStats(); stats.InFlight != 0 || stats.Admitted != 2 || stats.Rejected != 1 {
+		t.Errorf("Got %+v", stats)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	a := &admission{maxInFlight: 1, maxQueue: 1, queueTimeout: 10 * time.Millisecond}
+	a.acquire(context.Background())
+	if a.acquire(context.Background()) {
+		t.Errorf("Expected the queued request to time out")
+	}
+	if stats := a.currentStats(); stats.TimedOut != 1 || stats.Queued != 0 {
+		t.Errorf("Got %+v", stats)
+	}
+}
+
+func TestAdmissionCanceledWhileQueued(t *testing.T) {
+	a := &admission{maxInFlight: 1, maxQueue: 1, queueTimeout: time.Minute}
+	a.acquire(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan bool)
+	go func() { queued <- a.acquire(ctx) }()
+	waitFor(t, func() bool { return a.currentStats().Queued == 1 })
+	cancel()
+	select {
+	case admitted := <-queued:
+		if admitted {
+			t.Errorf("Expected the canceled request not to be admitted")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the canceled request to stop waiting")
+	}
+
+	a.release()
+	if stats := a.currentStats(); stats.InFlight != 0 || stats.Queued != 0 || stats.Abandoned != 1 {
+		t.Errorf("Got %+v", stats)
+	}
+	if a.acquire(ctx) {
+		t.Errorf("Expected a request whose client is gone not to be admitted")
+	}
+}
+
+func TestLimitConcurrencyResponds503(t *testing.T) {
+	defer func(a *admission) { extractions = a }(extractions)
+	extractions = &admission{maxInFlight: 1, maxQueue: 0, retryAfter: 2 * time.Second}
+	extractions.acquire(context.Background())
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/get", nil)
+	limitConcurrency(func(w http.ResponseWriter, r *http.Request) {})(recorder, req)
+
+	if recorder.Code != 503 || recorder.Header().Get("Retry-After") != "2" {
+		t.Errorf("Got %d with Retry-After '%v', wanted 503 with 2", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+func TestLimitConcurrencyBoundsRequestsByWriteTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { serverSettings.writeTimeout = timeout }(serverSettings.writeTimeout)
+	serverSettings.writeTimeout = 10 * time.Second
+
+	var remaining time.Duration
+	req, _ := http.NewRequest("GET", "/get", nil)
+	limitConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		if deadline, ok := r.Context().Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+	})(httptest.NewRecorder(), req)
+
+	if remaining <= 8*time.Second || remaining > 9*time.Second {
+		t.Errorf("Got %v left for the request, wanted 9s", remaining)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	scopeGet    = "get"
+	scopeBatch  = "batch"
+	scopeStatus = "status"
+	scopeAdmin  = "admin"
+)
+
+var knownScopes = map[string]bool{scopeGet: true, scopeBatch: true, scopeStatus: true, scopeAdmin: true}
+
+var auth = &authStore{}
+
+// clientsFile is the format of the file given with -api-keys:
+//
+//	{
+//		"clients": [
+//			{"name": "dashboard", "key": "s3cr3t", "scopes": ["get"], "per_minute": 60, "per_day": 10000}
+//		]
+//	}
+//
+// The admin scope includes all others. A quota of 0 means unlimited.
+type clientsFile struct {
+	Clients []*apiClient `json:"clients"`
+}
+
+type apiClient struct {
+	Name      string   `json:"name"`
+	Key       string   `json:"key"`
+	Scopes    []string `json:"scopes"`
+	PerMinute int      `json:"per_minute"`
+	PerDay    int      `json:"per_day"`
+
+	mu     sync.Mutex
+	minute quotaWindow
+	day    quotaWindow
+	usage  clientUsage
+}
+
+// quotaWindow counts requests in a fixed window of time.
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+type clientUsage struct {
+	Requests       int64
+	Rejected       int64
+	LastRequest    time.Time
+	RequestsMinute int
+	RequestsDay    int
+}
+
+func (c *apiClient) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// take counts a request against the client's quotas. When a quota is
+// exhausted it returns how long until the request may be retried.
+func (c *apiClient) take(now time.Time) (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	minuteStart := now.Truncate(time.Minute)
+	if !c.minute.start.Equal(minuteStart) {
+		c.minute = quotaWindow{start: minuteStart}
+	}
+	dayStart := now.UTC().Truncate(24 * time.Hour)
+	if !c.day.start.Equal(dayStart) {
+		c.day = quotaWindow{start: dayStart}
+	}
+
+	c.usage.LastRequest = now
+	if c.PerDay > 0 && c.day.count >= c.PerDay {
+		c.usage.Rejected++
+		return false, dayStart.Add(24 * time.Hour).Sub(now)
+	}
+	if c.PerMinute > 0 && c.minute.count >= c.PerMinute {
+		c.usage.Rejected++
+		return false, minuteStart.Add(time.Minute).Sub(now)
+	}
+	c.minute.count++
+	c.day.count++
+	c.usage.Requests++
+	return true, 0
+}
+
+func (c *apiClient) currentUsage() clientUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage := c.usage
+	usage.RequestsMinute = c.minute.count
+	usage.RequestsDay = c.day.count
+	return usage
+}
+
+// authStore holds the API clients. Without clients, authentication is off
+// and every request is allowed.
+type authStore struct {
+	byKey map[string]*apiClient
+}
+
+func (s *authStore) load(path string) error {
+	bytes, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	var file clientsFile
+	if e := json.Unmarshal(bytes, &file); e != nil {
+		return e
+	}
+
+	byKey := make(map[string]*apiClient)
+	for _, c := range file.Clients {
+		if c.Key == "" || c.Name == "" {
+			return fmt.Errorf("Every client needs a name and a key")
+		}
+		if _, ok := byKey[c.Key]; ok {
+			return fmt.Errorf("Key of client %s is not unique", c.Name)
+		}
+		for _, scope := range c.Scopes {
+			if !knownScopes[scope] {
+				return fmt.Errorf("Client %s has the unknown scope %q", c.Name, scope)
+			}
+		}
+		byKey[c.Key] = c
+	}
+	s.byKey = byKey
+	return nil
+}
+
+func (s *authStore) enabled() bool {
+	return len(s.byKey) > 0
+}
+
+func (s *authStore) usage() map[string]clientUsage {
+	if !s.enabled() {
+		return nil
+	}
+	usage := make(map[string]clientUsage)
+	for _, c := range s.byKey {
+		usage[c.Name] = c.currentUsage()
+	}
+	return usage
+}
+
+// requireScope wraps a handler so that it is only served to clients with
+// a valid API key carrying scope and quota left.
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !auth.enabled() {
+			handler(writer, req)
+			return
+		}
+
+		c, ok := auth.byKey[apiKey(req)]
+		if !ok {
+			writeAuthError(writer, req, http.StatusUnauthorized, "unauthorized", "Need a valid API key in the X-API-Key header or api_key parameter.")
+			return
+		}
+		if !c.hasScope(scope) {
+			writeAuthError(writer, req, http.StatusForbidden, "forbidden", fmt.Sprintf("API key %s lacks the %s scope.", c.Name, scope))
+			return
+		}
+		if ok, retryAfter := c.take(time.Now()); !ok {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeAuthError(writer, req, http.StatusTooManyRequests, "quota_exceeded", fmt.Sprintf("Quota of API key %s exceeded, retry in %d seconds.", c.Name, seconds))
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+func writeAuthError(writer http.ResponseWriter, req *http.Request, code int, errorCode string, message string) {
+	format, _ := negotiateFormat(req)
+	writeResult(writer, format, code, result{Error: message, ErrorCode: errorCode})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireScope(t *testing.T) {
+	defer func(byKey map[string]*apiClient) { auth.byKey = byKey }(auth.byKey)
+	auth.byKey = map[string]*apiClient{
+		"status-key": {Name: "monitoring", Key: "status-key", Scopes: []string{scopeStatus}},
+		"admin-key":  {Name: "ops", Key: "admin-key", Scopes: []string{scopeAdmin}},
+	}
+	handler := requireScope(scopeStatus, func(w http.ResponseWriter, r *http.Request) {})
+
+	for target, expected := range map[string]int{
+		"/_status":                    http.StatusUnauthorized,
+		"/_status?api_key=wrong":      http.StatusUnauthorized,
+		"/_status?api_key=status-key": http.StatusOK,
+		"/_status?api_key=admin-key":  http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", target, nil)
+		handler(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("Got status %d for %v, wanted %d", recorder.Code, target, expected)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/get", nil)
+	req.Header.Set("X-API-Key", "status-key")
+	requireScope(scopeGet, handler)(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Got status %d for missing scope, wanted 403", recorder.Code)
+	}
+}
+
+func TestBatchScope(t *testing.T) {
+	defer func(byKey map[string]*apiClient) { auth.byKey = byKey }(auth.byKey)
+	auth.byKey = map[string]*apiClient{
+		"get-key":   {Name: "dashboard", Key: "get-key", Scopes: []string{scopeGet}},
+		"batch-key": {Name: "importer", Key: "batch-key", Scopes: []string{scopeBatch}},
+	}
+	handler := requireScope(scopeBatch, func(w http.ResponseWriter, r *http.Request) {})
+
+	for key, expected := range map[string]int{"get-key": http.StatusForbidden, "batch-key": http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/batch", nil)
+		req.Header.Set("X-API-Key", key)
+		handler(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("Got status %d for %s, wanted %d", recorder.Code, key, expected)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownScopes(t *testing.T) {
+	dir, e := ioutil.TempDir("", "getxpath-auth")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clients.json")
+	ioutil.WriteFile(path, []byte(`{"clients": [{"name": "dashboard", "key": "k", "scopes": ["gte"]}]}`), 0600)
+
+	var store authStore
+	if e := store.load(path); e == nil || !strings.Contains(e.Error(), "dashboard") || !strings.Contains(e.Error(), "gte") {
+		t.Errorf("Got %v, wanted an error naming the client and the scope", e)
+	}
+}
+
+func TestQuotaPerMinute(t *testing.T) {
+	c := &apiClient{Name: "dashboard", PerMinute: 2, PerDay: 100}
+	now := time.Date(2019, 1, 1, 12, 0, 15, 0, time.UTC)
+
+	c.take(now)
+	c.take(now)
+	ok, retryAfter := c.take(now)
+	if ok || retryAfter != 45*time.Second {
+		t.Errorf("Got (%v, %v), wanted the third request refused for 45s", ok, retryAfter)
+	}
+	if ok, _ := c.take(now.Add(time.Minute)); !ok {
+		t.Errorf("Expected the quota to be reset in the next minute")
+	}
+	if usage := c.currentUsage(); usage.Requests != 3 || usage.Rejected != 1 || usage.RequestsDay != 3 {
+		t.Errorf("Got usage %+v", usage)
+	}
+}
+
+func TestQuotaExceededResponse(t *testing.T) {
+	defer func(byKey map[string]*apiClient) { auth.byKey = byKey }(auth.byKey)
+	auth.byKey = map[string]*apiClient{
+		"key": {Name: "dashboard", Key: "key", Scopes: []string{scopeGet}, PerDay: 1},
+	}
+	handler := requireScope(scopeGet, func(w http.ResponseWriter, r *http.Request) {})
+
+	var recorder *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		recorder = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/get?api_key=key", nil)
+		handler(recorder, req)
+	}
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Got status %d and Retry-After '%v', wanted 429 with Retry-After", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
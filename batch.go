@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often batch progress is reported on stderr.
+const progressInterval = 250 * time.Millisecond
+
+const (
+	// maxBatchQueries limits the queries of a POST /batch request.
+	maxBatchQueries = 100
+	// maxBatchBodySize limits the size of the body of POST /batch.
+	maxBatchBodySize = 1 << 20
+	// batchConcurrency is the number of queries of a POST /batch request
+	// extracted at once.
+	batchConcurrency = 4
+)
+
+type batchJob struct {
+	index int
+	id    string
+	q     query
+	// err is set when the input record could not be read.
+	err error
+}
+
+type batchResult struct {
+	ID string `json:"id"`
+	result
+}
+
+// batchLine is a JSONL input record.
+type batchLine struct {
+	ID interface{} `json:"id"`
+	query
+}
+
+// runBatch extracts the queries of a JSONL or CSV file with parallel
+// workers. Results are written as JSONL or CSV in input or completion
+// order. When the output file exists, the ids it holds successful results
+// for are skipped and new results are appended, so an interrupted batch can
+// be resumed and its failed queries retried. The results of failed queries
+// are removed from the file before they are retried.
+func runBatch(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("batch", stderr)
+	var c config
+	registerLocalSettings(fs, &c)
+	contentType := fs.String("content-type", "", "Media type and charset of the documents without content_type option, overriding detection")
+	inputFormat := fs.String("input-format", "", "jsonl or csv, by default from the file extension")
+	output := fs.String("output", "", "File to write results to instead of stdout")
+	outputFormat := fs.String("output-format", "", "jsonl or csv, by default from the output file extension or jsonl")
+	concurrency := fs.Int("concurrency", 4, "Number of queries extracted at once")
+	order := fs.String("order", "input", "Write results in input or completion order")
+	resume := fs.Bool("resume", true, "Skip the ids with successful results in the output file and append to it")
+	progress := fs.Bool("progress", true, "Report progress on stderr")
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if *inputFormat == "" {
+		*inputFormat = formatFromExtension(fs.Arg(0), "jsonl")
+	}
+	if *outputFormat == "" {
+		*outputFormat = formatFromExtension(*output, "jsonl")
+	}
+	if fs.NArg() != 1 || *concurrency < 1 || !validBatchFormat(*inputFormat) || !validBatchFormat(*outputFormat) ||
+		(*order != "input" && *order != "completion") {
+		fs.Usage()
+		return exitUsage
+	}
+	logger.SetOutput(stderr)
+	// Queries read from stdin cannot read their document from there too.
+	enableLocalFiles(fs.Arg(0) != stdinURL)
+
+	fail := func(e error) int {
+		fmt.Fprintf(stderr, "getxpath batch: %v\n", e)
+		return exitFailure
+	}
+
+	in := stdin
+	if fs.Arg(0) != stdinURL {
+		f, e := os.Open(fs.Arg(0))
+		if e != nil {
+			return fail(e)
+		}
+		defer f.Close()
+		in = f
+	}
+	jobs, e := readBatchJobs(in, *inputFormat)
+	if e != nil {
+		return fail(e)
+	}
+
+	out := stdout
+	appending := false
+	if *output != "" {
+		completed := make(map[string]bool)
+		if *resume {
+			if completed, e = readCompletedIDs(*output, *outputFormat); e != nil {
+				return fail(e)
+			}
+		}
+		total := len(jobs)
+		jobs = skipCompleted(jobs, completed)
+		skipped := total - len(jobs)
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *resume {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+			if appending, e = trimPartialLine(*output); e != nil {
+				return fail(e)
+			}
+			if appending {
+				if appending, e = dropRetriedResults(*output, *outputFormat, jobs); e != nil {
+					return fail(e)
+				}
+			}
+		}
+		f, e := os.OpenFile(*output, flags, 0644)
+		if e != nil {
+			return fail(e)
+		}
+		defer f.Close()
+		out = f
+		if skipped > 0 {
+			fmt.Fprintf(stderr, "getxpath batch: skipping %d ids already done in %s\n", skipped, *output)
+		}
+	}
+	writer := newBatchWriter(out, *outputFormat, !appending)
+
+	start := time.Now()
+	var reporter *progressReporter
+	if *progress {
+		reporter = &progressReporter{w: stderr, total: len(jobs)}
+	}
+	succeeded, failed, e := runBatchJobs(context.Background(), jobs, *concurrency, *order == "input", *contentType, writer, reporter)
+	if e != nil {
+		return fail(e)
+	}
+
+	fmt.Fprintf(stderr, "getxpath batch: %d queries, %d succeeded, %d failed in %v\n",
+		len(jobs), succeeded, failed, time.Since(start).Round(time.Millisecond))
+	if failed > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// batchHandler extracts the queries of a POST /batch request, JSONL or, with
+// Content-Type text/csv, CSV like the input of the batch command, and
+// answers with their results in the same format and order. Every query has
+// to pass the URL policy of the client.
+func batchHandler(writer http.ResponseWriter, req *http.Request) {
+	startRequest(req)
+	format := "jsonl"
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "text/csv" {
+		format = "csv"
+	}
+
+	fail := func(code int, message string) {
+		countResult(true)
+		writeResult(writer, resultFormats[0], code, result{Error: message})
+	}
+	if req.Method != "POST" {
+		fail(405, "Only POST is supported.")
+		return
+	}
+	jobs, e := readBatchJobs(http.MaxBytesReader(writer, req.Body, maxBatchBodySize), format)
+	if e != nil {
+		fail(400, e.Error())
+		return
+	}
+	if len(jobs) == 0 || len(jobs) > maxBatchQueries {
+		fail(400, fmt.Sprintf("Need 1 to %d queries, one per line.", maxBatchQueries))
+		return
+	}
+
+	p := policies.policyFor(apiKey(req))
+	for i := range jobs {
+		if jobs[i].err == nil {
+			jobs[i].err = p.check(jobs[i].q.URL)
+		}
+	}
+	ctx := withFetchChecks(req.Context(), &fetchChecks{policy: p})
+
+	if format == "csv" {
+		writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		writer.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	}
+	_, failed, e := runBatchJobs(ctx, jobs, batchConcurrency, true, "", newBatchWriter(writer, format, true), nil)
+	if e != nil {
+		logger.Printf("ERROR: Could not write batch results: %v", e)
+	}
+	countResult(failed > 0)
+}
+
+func formatFromExtension(path string, otherwise string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".ndjson", ".json":
+		return "jsonl"
+	}
+	return otherwise
+}
+
+func validBatchFormat(format string) bool {
+	return format == "jsonl" || format == "csv"
+}
+
+// readBatchJobs reads JSONL records with url, xpath or css and optional id
+// and options, or CSV records with a header naming the url, xpath and optional
+// id and content_type columns. Records without id are numbered.
+func readBatchJobs(r io.Reader, format string) ([]batchJob, error) {
+	if format == "csv" {
+		return readCSVJobs(r)
+	}
+
+	var jobs []batchJob
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxQueryBodySize)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		job := batchJob{index: len(jobs), id: strconv.Itoa(line)}
+		var record batchLine
+		if e := json.Unmarshal(scanner.Bytes(), &record); e != nil {
+			job.err = fmt.Errorf("Line %d: %v", line, e)
+		} else {
+			job.q = record.query
+			if record.ID != nil {
+				job.id = fmt.Sprint(record.ID)
+			}
+			if e := translateCSS(&job.q); e != nil {
+				job.err = fmt.Errorf("Line %d: %v", line, e)
+			} else if job.q.URL == "" || job.q.Xpath == "" {
+				job.err = fmt.Errorf("Line %d: Need url and xpath.", line)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, scanner.Err()
+}
+
+func readCSVJobs(r io.Reader) ([]batchJob, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, e := reader.Read()
+	if e != nil {
+		return nil, fmt.Errorf("Could not read CSV header: %v", e)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, fmt.Errorf("CSV input needs a header with url and xpath columns.")
+	}
+	if _, ok := columns["xpath"]; !ok {
+		return nil, fmt.Errorf("CSV input needs a header with url and xpath columns.")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var jobs []batchJob
+	for row := 1; ; row++ {
+		record, e := reader.Read()
+		if e == io.EOF {
+			return jobs, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+		job := batchJob{
+			index: len(jobs),
+			id:    field(record, "id"),
+			q:     query{URL: field(record, "url"), Xpath: field(record, "xpath")},
+		}
+		if job.id == "" {
+			job.id = strconv.Itoa(row)
+		}
+		if contentType := field(record, "content_type"); contentType != "" {
+			job.q.Options = &queryOptions{ContentType: contentType}
+		}
+		if job.q.URL == "" || job.q.Xpath == "" {
+			job.err = fmt.Errorf("Row %d: Need url and xpath.", row)
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// readCompletedIDs returns the ids of the successful results in an existing
+// output file, so that failed queries are tried again. A last line cut off
+// by an interruption is ignored.
+func readCompletedIDs(path string, format string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	f, e := os.Open(path)
+	if os.IsNotExist(e) {
+		return ids, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	if format == "csv" {
+		reader := csv.NewReader(f)
+		reader.FieldsPerRecord = -1
+		for {
+			record, e := reader.Read()
+			if e != nil {
+				return ids, nil
+			}
+			if len(record) == len(batchCSVHeader) && record[0] != batchCSVHeader[0] && record[batchCSVErrorColumn] == "" {
+				ids[record[0]] = true
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var res struct {
+			ID    *string     `json:"id"`
+			Error interface{} `json:"error"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &res) == nil && res.ID != nil && res.Error == nil {
+			ids[*res.ID] = true
+		}
+	}
+	return ids, scanner.Err()
+}
+
+// trimPartialLine cuts off a last line left incomplete by an interruption
+// and returns whether anything remains in the file.
+func trimPartialLine(path string) (bool, error) {
+	bytez, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) {
+		return false, nil
+	}
+	if e != nil {
+		return false, e
+	}
+	end := bytes.LastIndexByte(bytez, '\n') + 1
+	if end < len(bytez) {
+		if e := os.Truncate(path, int64(end)); e != nil {
+			return false, e
+		}
+	}
+	return end > 0, nil
+}
+
+// dropRetriedResults rewrites an existing output file without the results
+// of the jobs about to be run again, so that every id keeps the results of
+// its last run only. It returns whether anything remains in the file.
+func dropRetriedResults(path string, format string, jobs []batchJob) (bool, error) {
+	retried := make(map[string]bool)
+	for _, job := range jobs {
+		retried[job.id] = true
+	}
+	bytez, e := ioutil.ReadFile(path)
+	if e != nil {
+		return false, e
+	}
+
+	var kept bytes.Buffer
+	dropped := false
+	if format == "csv" {
+		reader := csv.NewReader(bytes.NewReader(bytez))
+		reader.FieldsPerRecord = -1
+		writer := csv.NewWriter(&kept)
+		for first := true; ; first = false {
+			record, e := reader.Read()
+			if e != nil {
+				// A record cut off by an interruption is dropped too.
+				dropped = dropped || e != io.EOF
+				break
+			}
+			header := first && record[0] == batchCSVHeader[0]
+			if !header && retried[record[0]] {
+				dropped = true
+				continue
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+	} else {
+		for _, line := range bytes.SplitAfter(bytez, []byte("\n")) {
+			var res struct {
+				ID *string `json:"id"`
+			}
+			if json.Unmarshal(line, &res) == nil && res.ID != nil && retried[*res.ID] {
+				dropped = true
+				continue
+			}
+			kept.Write(line)
+		}
+	}
+	if !dropped {
+		return len(bytez) > 0, nil
+	}
+
+	f, e := ioutil.TempFile(filepath.Dir(path), ".getxpath-batch-")
+	if e != nil {
+		return false, e
+	}
+	_, e = f.Write(kept.Bytes())
+	if closeErr := f.Close(); e == nil {
+		e = closeErr
+	}
+	if e == nil {
+		e = os.Rename(f.Name(), path)
+	}
+	if e != nil {
+		os.Remove(f.Name())
+		return false, e
+	}
+	return kept.Len() > 0, nil
+}
+
+func skipCompleted(jobs []batchJob, completed map[string]bool) []batchJob {
+	var remaining []batchJob
+	for _, job := range jobs {
+		if !completed[job.id] {
+			job.index = len(remaining)
+			remaining = append(remaining, job)
+		}
+	}
+	return remaining
+}
+
+// runBatchJobs extracts the jobs with concurrency workers and writes the
+// results in input order or as they complete.
+func runBatchJobs(ctx context.Context, jobs []batchJob, concurrency int, inputOrder bool, contentType string, writer batchWriter, reporter *progressReporter) (int, int, error) {
+	type done struct {
+		index int
+		res   batchResult
+	}
+	queue := make(chan batchJob)
+	results := make(chan done)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				res := batchResult{ID: job.id, result: result{Query: job.q}}
+				if job.err != nil {
+					res.Error = job.err.Error()
+					res.ErrorCode = errorCode(job.err)
+				} else {
+					content, _, e := extractQuery(ctx, withContentType(job.q, contentType))
+					res.Result = content
+					res.Error = errorMessageOrNil(e)
+					res.ErrorCode = errorCode(e)
+				}
+				results <- done{job.index, res}
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	succeeded, failed := 0, 0
+	pending := make(map[int]batchResult)
+	next := 0
+	var writeErr error
+	write := func(res batchResult) {
+		if writeErr == nil {
+			writeErr = writer.write(res)
+		}
+	}
+	for d := range results {
+		res := d.res
+		if res.Error != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+		if !inputOrder {
+			write(res)
+		} else {
+			pending[d.index] = res
+			for r, ok := pending[next]; ok; r, ok = pending[next] {
+				write(r)
+				delete(pending, next)
+				next++
+			}
+		}
+		reporter.update(succeeded, failed)
+	}
+	reporter.finish(succeeded, failed)
+
+	if e := writer.flush(); writeErr == nil {
+		writeErr = e
+	}
+	return succeeded, failed, writeErr
+}
+
+var batchCSVHeader = append([]string{"id"}, csvHeader...)
+
+// batchCSVErrorColumn is the index of the error column of batchCSVHeader.
+const batchCSVErrorColumn = 4
+
+type batchWriter interface {
+	write(res batchResult) error
+	flush() error
+}
+
+func newBatchWriter(w io.Writer, format string, header bool) batchWriter {
+	if format == "csv" {
+		return &csvBatchWriter{writer: csv.NewWriter(w), header: header}
+	}
+	return &jsonlBatchWriter{encoder: json.NewEncoder(w)}
+}
+
+type jsonlBatchWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonlBatchWriter) write(res batchResult) error {
+	return w.encoder.Encode(res)
+}
+
+func (w *jsonlBatchWriter) flush() error {
+	return nil
+}
+
+type csvBatchWriter struct {
+	writer *csv.Writer
+	header bool
+}
+
+func (w *csvBatchWriter) write(res batchResult) error {
+	if w.header {
+		w.writer.Write(batchCSVHeader)
+		w.header = false
+	}
+	w.writer.Write(append([]string{res.ID}, csvRecord(res.result)...))
+	// Flush every record so an interrupted batch can be resumed.
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvBatchWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// progressReporter rewrites a progress line on stderr. A nil reporter
+// reports nothing.
+type progressReporter struct {
+	w     io.Writer
+	total int
+	last  time.Time
+}
+
+func (p *progressReporter) update(succeeded, failed int) {
+	if p == nil || time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	p.print(succeeded, failed)
+}
+
+func (p *progressReporter) finish(succeeded, failed int) {
+	if p == nil {
+		return
+	}
+	p.print(succeeded, failed)
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressReporter) print(succeeded, failed int) {
+	fmt.Fprintf(p.w, "\rgetxpath batch: %d/%d done, %d failed", succeeded+failed, p.total, failed)
+}
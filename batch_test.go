@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBatchTestServer serves pages whose title is their path, answering
+// /slow later than the others.
+func newBatchTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "<html><head><title>%s</title></head></html>", r.URL.Path)
+	}))
+}
+
+func writeBatchInput(t *testing.T, name string, content string) (string, string) {
+	dir, e := ioutil.TempDir("", "getxpath-batch")
+	if e != nil {
+		t.Fatal(e)
+	}
+	path := filepath.Join(dir, name)
+	if e := ioutil.WriteFile(path, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return dir, path
+}
+
+func TestBatchJSONLInInputOrder(t *testing.T) {
+	defer saveSettings()()
+	server := newBatchTestServer()
+	defer server.Close()
+	_, path := writeBatchInput(t, "queries.jsonl", fmt.Sprintf(
+		"{\"id\": \"a\", \"url\": \"%s/slow\", \"xpath\": \"//title\"}\n\n{\"url\": \"%s/fast\", \"xpath\": \"//title\"}\n{\"url\": \"%s\"}\n",
+		server.URL, server.URL, server.URL))
+
+	code, stdout, stderr := runTestCommand("batch", "-host-rate", "0", "-concurrency", "3", "-progress=false", path)
+	if code != exitFailure || !strings.Contains(stderr, "3 queries, 2 succeeded, 1 failed") {
+		t.Errorf("Got exit code %d and '%s'", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"id":"a"`) || !strings.Contains(lines[0], `"result":"/slow"`) ||
+		!strings.Contains(lines[1], `"id":"3"`) || !strings.Contains(lines[2], "Line 4: Need url and xpath.") {
+		t.Errorf("Got '%s'", stdout)
+	}
+}
+
+func TestBatchCompletionOrder(t *testing.T) {
+	defer saveSettings()()
+	server := newBatchTestServer()
+	defer server.Close()
+	_, path := writeBatchInput(t, "queries.csv", fmt.Sprintf("url,xpath\n%s/slow,//title\n%s/fast,//title\n", server.URL, server.URL))
+
+	code, stdout, _ := runTestCommand("batch", "-host-rate", "0", "-concurrency", "2", "-order", "completion", "-progress=false", path)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if code != exitOK || len(lines) != 2 || !strings.Contains(lines[0], `"result":"/fast"`) {
+		t.Errorf("Got exit code %d and '%s'", code, stdout)
+	}
+}
+
+func TestBatchCSVResume(t *testing.T) {
+	defer saveSettings()()
+	server := newBatchTestServer()
+	defer server.Close()
+	dir, path := writeBatchInput(t, "queries.csv", fmt.Sprintf("id,url,xpath\none,%s/1,//title\ntwo,%s/2,//title\nthree,%s/3,//title\n", server.URL, server.URL, server.URL))
+	output := filepath.Join(dir, "results.csv")
+	// An earlier run completed "one", failed "three" and was interrupted
+	// while writing "two".
+	ioutil.WriteFile(output, []byte("id,url,xpath,result,error,error_code\none,u,x,/1,,\nthree,u,x,,Timeout,\n\"two,u"), 0600)
+
+	code, _, stderr := runTestCommand("batch", "-host-rate", "0", "-output", output, path)
+	if code != exitOK || !strings.Contains(stderr, "skipping 1 ids") || !strings.Contains(stderr, "2/2 done") {
+		t.Errorf("Got exit code %d and '%s'", code, stderr)
+	}
+
+	ids, e := readCompletedIDs(output, "csv")
+	if e != nil || len(ids) != 3 || !ids["two"] || !ids["three"] {
+		t.Errorf("Got %v, %v", ids, e)
+	}
+	bytez, _ := ioutil.ReadFile(output)
+	if lines := strings.Split(strings.TrimSpace(string(bytez)), "\n"); len(lines) != 4 || lines[0] != "id,url,xpath,result,error,error_code" || strings.Contains(string(bytez), "Timeout") {
+		t.Errorf("Expected a header and one row per id, got %s", bytez)
+	}
+}
+
+func TestDropRetriedResults(t *testing.T) {
+	_, output := writeBatchInput(t, "results.jsonl", `{"id":"one","result":"/1","error":null}
+{"id":"two","result":"","error":"Timeout"}
+`)
+
+	appending, e := dropRetriedResults(output, "jsonl", []batchJob{{id: "two"}})
+	bytez, _ := ioutil.ReadFile(output)
+	if e != nil || !appending || string(bytez) != `{"id":"one","result":"/1","error":null}`+"\n" {
+		t.Errorf("Got %v, %v and %s", appending, e, bytez)
+	}
+
+	appending, e = dropRetriedResults(output, "jsonl", []batchJob{{id: "one"}})
+	if bytez, _ = ioutil.ReadFile(output); e != nil || appending || len(bytez) != 0 {
+		t.Errorf("Got %v, %v and %s", appending, e, bytez)
+	}
+}
+
+func TestReadCompletedIDsSkipsFailures(t *testing.T) {
+	_, output := writeBatchInput(t, "results.jsonl", `{"id":"one","result":"/1","error":null}
+{"id":"two","result":"","error":"Xpath not found"}
+{"id":"three","result":"","error":"Timeout"}
+{"id":"three","result":"/3","error":null}
+`)
+
+	ids, e := readCompletedIDs(output, "jsonl")
+	if e != nil || len(ids) != 2 || !ids["one"] || ids["two"] || !ids["three"] {
+		t.Errorf("Got %v, %v", ids, e)
+	}
+}
+
+func TestReadCSVJobsNeedsHeader(t *testing.T) {
+	if _, e := readBatchJobs(strings.NewReader("http://example.com,//title\n"), "csv"); e == nil {
+		t.Errorf("Expected an error for CSV input without header")
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	defer allowLoopback()()
+	server := newBatchTestServer()
+	defer server.Close()
+	defer func(file policyFile) { policies.file = file }(policies.file)
+	policies.file = policyFile{Default: &policy{Deny: []policyRule{{PathPrefixes: []string{"/denied"}}}}}
+
+	body := fmt.Sprintf(`{"id": "a", "url": "%s/1", "xpath": "//title"}
+{"id": "b", "url": "%s/denied", "xpath": "//title"}
+{"id": "c", "url": "%s/3", "css": "title"}
+`, server.URL, server.URL, server.URL)
+	recorder := httptest.NewRecorder()
+	batchHandler(recorder, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if recorder.Code != 200 || len(lines) != 3 {
+		t.Fatalf("Got %d and %s", recorder.Code, recorder.Body.String())
+	}
+	if !strings.Contains(lines[0], `"id":"a"`) || !strings.Contains(lines[0], `"result":"/1"`) ||
+		!strings.Contains(lines[1], `"error_code":"policy_denied"`) || !strings.Contains(lines[2], `"result":"/3"`) {
+		t.Errorf("Got %s", recorder.Body.String())
+	}
+
+	req := httptest.NewRequest("POST", "/batch", strings.NewReader("id,url,xpath\none,"+server.URL+"/1,//title\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	recorder = httptest.NewRecorder()
+	batchHandler(recorder, req)
+	if recorder.Body.String() != "id,url,xpath,result,error,error_code\none,"+server.URL+"/1,//title,/1,,\n" {
+		t.Errorf("Got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	batchHandler(recorder, httptest.NewRequest("POST", "/batch", strings.NewReader(strings.Repeat(`{"url": "x", "xpath": "//a"}`+"\n", maxBatchQueries+1))))
+	if recorder.Code != 400 {
+		t.Errorf("Got %d for too many queries, wanted 400", recorder.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+)
+
+// cachedHeaders are the upstream response headers kept with a cached page.
+var cachedHeaders = []string{"Content-Type", "Cache-Control", "Expires", "Date", "Etag", "Last-Modified"}
+
+var bodyCache = newResponseCache(256, 64<<20)
+
+type cacheStats struct {
+	Hits          int64
+	Misses        int64
+	Revalidations int64
+	Entries       int64
+	Bytes         int64
+}
+
+type cacheEntry struct {
+	url       string
+	header    http.Header
+	body      []byte
+	redirects []string
+	storedAt  time.Time
+	expires   time.Time
+	noCache   bool
+}
+
+// fresh reports whether the entry may be served without asking upstream.
+// A per-request max_age replaces the freshness lifetime given by upstream.
+func (entry *cacheEntry) fresh(now time.Time, options *queryOptions) bool {
+	if options != nil && options.NoCache {
+		return false
+	}
+	if options != nil && options.MaxAge != nil {
+		return now.Sub(entry.storedAt) <= time.Duration(*options.MaxAge)*time.Second
+	}
+	return !entry.noCache && now.Before(entry.expires)
+}
+
+func (entry *cacheEntry) size() int64 {
+	return int64(len(entry.body) + len(entry.url))
+}
+
+// responseCache is a bounded LRU of upstream responses keyed by URL.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	ll         *list.List
+	items      map[string]*list.Element
+
+	hits, misses, revalidations int64
+}
+
+func newResponseCache(maxEntries int, maxBytes int64) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(url string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[url]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+func (c *responseCache) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxEntries <= 0 || entry.size() > c.maxBytes {
+		return
+	}
+	if el, ok := c.items[entry.url]; ok {
+		c.removeElement(el)
+	}
+	c.items[entry.url] = c.ll.PushFront(entry)
+	c.bytes += entry.size()
+
+	for c.ll.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *responseCache) remove(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[url]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *responseCache) removeElement(el *list.Element) {
+	entry := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, entry.url)
+	c.bytes -= entry.size()
+}
+
+func (c *responseCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return cacheStats{
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		Revalidations: atomic.LoadInt64(&c.revalidations),
+		Entries:       int64(c.ll.Len()),
+		Bytes:         c.bytes,
+	}
+}
+
+// readBodyCached returns the page at url from bodyCache when it is still
+// fresh, revalidates it upstream with ETag/Last-Modified when it is not and
+// falls back to a plain fetch otherwise. The second return value tells which
+// of these happened.
+func readBodyCached(ctx context.Context, url string, options *queryOptions) (*upstreamResponse, string, error) {
+	now := time.Now()
+	entry := bodyCache.get(url)
+	if entry != nil && entry.fresh(now, options) {
+		atomic.AddInt64(&bodyCache.hits, 1)
+		return entry.response(), cacheHit, nil
+	}
+
+	header := http.Header{}
+	if entry != nil {
+		if etag := entry.header.Get("Etag"); etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.header.Get("Last-Modified"); lastModified != "" {
+			header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, e := readBodyCoalesced(ctx, url, header)
+	if e != nil {
+		return nil, "", e
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		atomic.AddInt64(&bodyCache.revalidations, 1)
+		header := mergeHeaders(entry.header, resp.Header)
+		if revalidated := newCacheEntry(url, header, entry.body, resp.Redirects, now); revalidated != nil {
+			bodyCache.add(revalidated)
+		} else {
+			bodyCache.remove(url)
+		}
+		return &upstreamResponse{StatusCode: http.StatusOK, Header: header, Body: entry.body, Redirects: resp.Redirects}, cacheRevalidated, nil
+	}
+
+	atomic.AddInt64(&bodyCache.misses, 1)
+	if resp.StatusCode == http.StatusOK {
+		if fetched := newCacheEntry(url, resp.Header, resp.Body, resp.Redirects, now); fetched != nil {
+			bodyCache.add(fetched)
+		} else {
+			bodyCache.remove(url)
+		}
+	}
+	return resp, cacheMiss, nil
+}
+
+// newCacheEntry builds a cache entry for a response, or returns nil when the
+// upstream Cache-Control forbids a shared cache like this one to store it.
+func newCacheEntry(url string, header http.Header, body []byte, redirects []string, now time.Time) *cacheEntry {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	if _, ok := directives["private"]; ok {
+		return nil
+	}
+
+	entry := &cacheEntry{
+		url:       url,
+		header:    http.Header{},
+		body:      body,
+		redirects: redirects,
+		storedAt:  now,
+		expires:   now,
+	}
+	for _, name := range cachedHeaders {
+		if v, ok := header[name]; ok {
+			entry.header[name] = v
+		}
+	}
+	if _, ok := directives["no-cache"]; ok {
+		entry.noCache = true
+	}
+
+	if seconds, ok := deltaSeconds(directives["s-maxage"]); ok {
+		entry.expires = now.Add(seconds)
+	} else if seconds, ok := deltaSeconds(directives["max-age"]); ok {
+		entry.expires = now.Add(seconds)
+	} else if expires := header.Get("Expires"); expires != "" {
+		if t, e := http.ParseTime(expires); e == nil {
+			entry.expires = now.Add(t.Sub(responseDate(header, now)))
+		}
+	}
+	return entry
+}
+
+func (entry *cacheEntry) response() *upstreamResponse {
+	return &upstreamResponse{StatusCode: http.StatusOK, Header: entry.header, Body: entry.body, Redirects: entry.redirects}
+}
+
+// responseDate is the upstream Date header, used to interpret Expires
+// relative to the server's clock rather than ours.
+func responseDate(header http.Header, now time.Time) time.Time {
+	if t, e := http.ParseTime(header.Get("Date")); e == nil {
+		return t
+	}
+	return now
+}
+
+// mergeHeaders updates stored headers with those sent along a 304 response.
+func mergeHeaders(stored http.Header, update http.Header) http.Header {
+	merged := http.Header{}
+	for k, v := range stored {
+		merged[k] = v
+	}
+	for _, name := range cachedHeaders {
+		if v, ok := update[name]; ok {
+			merged[name] = v
+		}
+	}
+	return merged
+}
+
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, arg = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = arg
+	}
+	return directives
+}
+
+func deltaSeconds(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	n, e := strconv.ParseInt(value, 10, 64)
+	if e != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPage = "<html><head><title>Cached Page</title></head><body></body></html>"
+
+func TestCacheHitForFreshPage(t *testing.T) {
+	defer allowLoopback()()
+	bodyCache = newResponseCache(16, 1<<20)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheMiss)
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheHit)
+	if requests != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", requests)
+	}
+}
+
+func TestCacheRevalidatesWithEtag(t *testing.T) {
+	defer allowLoopback()()
+	bodyCache = newResponseCache(16, 1<<20)
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheMiss)
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheRevalidated)
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Expected 2 upstream requests with 1 not modified, got %d and %d", requests, notModified)
+	}
+}
+
+func TestCacheMaxAgeOverride(t *testing.T) {
+	defer allowLoopback()()
+	bodyCache = newResponseCache(16, 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	maxAge := 60
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheMiss)
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheMiss)
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title", Options: &queryOptions{MaxAge: &maxAge}}, cacheHit)
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title", Options: &queryOptions{MaxAge: &maxAge, NoCache: true}}, cacheMiss)
+}
+
+func TestCacheSkipsNoStore(t *testing.T) {
+	defer allowLoopback()()
+	bodyCache = newResponseCache(16, 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	expectCacheStatus(t, query{URL: server.URL, Xpath: "//title"}, cacheMiss)
+	if entries := bodyCache.stats().Entries; entries != 0 {
+		t.Errorf("Expected no-store page not to be cached, got %d entries", entries)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(2, 1<<20)
+	cache.add(&cacheEntry{url: "a"})
+	cache.add(&cacheEntry{url: "b"})
+	cache.get("a")
+	cache.add(&cacheEntry{url: "c"})
+
+	if cache.get("b") != nil {
+		t.Errorf("Expected b to be evicted")
+	}
+	if cache.get("a") == nil || cache.get("c") == nil {
+		t.Errorf("Expected a and c to be cached")
+	}
+}
+
+func expectCacheStatus(t *testing.T, q query, expected string) {
+	actual, info, e := extractQuery(context.Background(), q)
+	if e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+	if actual != "Cached Page" {
+		t.Errorf("Got extractQuery(%v) = '%v', wanted 'Cached Page'", q, actual)
+	}
+	if info.Cache != expected {
+		t.Errorf("Got cache status '%v', wanted '%v'", info.Cache, expected)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Exit codes of the command-line tool.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	name     string
+	synopsis string
+	summary  string
+	run      func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"get", "[flags] <url> <xpath>", "Extract an XPath from the document at a URL, a file:// URL or - for stdin", runGet},
+		{"serve", "[flags]", "Run the HTTP server", runServe},
+		{"batch", "[flags] <file>", "Extract the queries in a JSONL or CSV file, - for stdin, in parallel", runBatch},
+		{"repl", "[flags] <url>", "Evaluate XPaths interactively on a document fetched once", runREPL},
+		{"suggest", "[flags] <url> <text>", "Propose XPaths extracting a text shown on a page", runSuggest},
+		{"validate", "<xpath>...", "Check the syntax of XPaths", runValidate},
+		{"config", "print [flags]", "Print the effective configuration", runConfig},
+		{"version", "", "Print the version", runVersion},
+	}
+}
+
+// runCommand runs the subcommand named by the first argument and returns
+// the exit code.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		return runLegacy(args, stdout, stderr)
+	}
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], stdout, stderr)
+		}
+	}
+	fmt.Fprintf(stderr, "getxpath: unknown command %q\n\n", args[0])
+	printUsage(stderr)
+	return exitUsage
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: getxpath <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun 'getxpath <command> -h' for the flags of a command.\n")
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, c := range commands {
+		if c.name == name {
+			fs.Usage = func() {
+				fmt.Fprintf(stderr, "Usage: getxpath %s %s\n\n%s.\n", c.name, c.synopsis, c.summary)
+				if hasFlags(fs) {
+					fmt.Fprintf(stderr, "\nFlags:\n")
+					fs.PrintDefaults()
+				}
+			}
+		}
+	}
+	return fs
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	any := false
+	fs.VisitAll(func(*flag.Flag) { any = true })
+	return any
+}
+
+// registerLocalSettings is registerSettings for the commands fetching on
+// behalf of the user running them, who may well want to query their own
+// machine or network: the SSRF protection is off unless turned on.
+func registerLocalSettings(fs *flag.FlagSet, c *config) {
+	guard.enabled = false
+	registerSettings(fs, c)
+}
+
+// parseFlags parses args and loads the settings if c is not nil. It returns
+// the exit code to stop with if that failed or help was asked for.
+func parseFlags(fs *flag.FlagSet, c *config, args []string, stderr io.Writer) (int, bool) {
+	// The flag package reports its own errors.
+	if e := fs.Parse(args); e == flag.ErrHelp {
+		return exitOK, false
+	} else if e != nil {
+		return exitUsage, false
+	}
+	if c != nil {
+		if e := loadConfig(fs, c); e != nil {
+			fmt.Fprintf(stderr, "getxpath %s: %v\n", fs.Name(), e)
+			return exitUsage, false
+		}
+	}
+	return exitOK, true
+}
+
+func runGet(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("get", stderr)
+	var c config
+	registerLocalSettings(fs, &c)
+	output := fs.String("output", "raw", "Output format: raw prints just the result, json the result with query and error")
+	contentType := fs.String("content-type", "", "Media type and charset of the document, overriding detection")
+	explain := fs.Bool("explain", false, "Show how far the XPath got if it selects nothing")
+	vars := variablesFlag{}
+	fs.Var(vars, "var", "Bind the XPath variable $name, as in -var name=value (repeatable)")
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if fs.NArg() != 2 || (*output != "raw" && *output != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+	enableLocalFiles(true)
+	q := withContentType(query{URL: fs.Arg(0), Xpath: fs.Arg(1)}, *contentType)
+	if len(vars) > 0 {
+		q.Vars = vars
+	}
+	if *explain {
+		q = withExplain(q)
+	}
+	return extractOne(q, *output == "json", stdout, stderr)
+}
+
+func extractOne(q query, asJSON bool, stdout, stderr io.Writer) int {
+	logger.SetOutput(stderr)
+	content, info, e := extractQuery(context.Background(), q)
+	if asJSON {
+		res := result{Query: q, Result: content, Error: errorMessageOrNil(e), ErrorCode: errorCode(e), Explanation: info.Explanation}
+		if err := encodeNDJSON(stdout, res); err != nil {
+			fmt.Fprintf(stderr, "getxpath get: %v\n", err)
+			return exitFailure
+		}
+	} else if e == nil {
+		fmt.Fprintln(stdout, content)
+	}
+	if e != nil {
+		fmt.Fprintf(stderr, "getxpath get: %v\n", e)
+		if info.Explanation != nil && !asJSON {
+			printExplanation(stderr, info.Explanation)
+		}
+		return exitFailure
+	}
+	return exitOK
+}
+
+// enableLocalFiles lets the command-line tool read any file, unless
+// restricted by -file-root, and optionally stdin.
+func enableLocalFiles(stdin bool) {
+	localFiles.enabled = true
+	localFiles.stdin = stdin
+}
+
+func withContentType(q query, contentType string) query {
+	if contentType == "" || q.Options != nil && q.Options.ContentType != "" {
+		return q
+	}
+	options := queryOptions{}
+	if q.Options != nil {
+		options = *q.Options
+	}
+	options.ContentType = contentType
+	q.Options = &options
+	return q
+}
+
+func withExplain(q query) query {
+	options := queryOptions{}
+	if q.Options != nil {
+		options = *q.Options
+	}
+	options.Explain = true
+	q.Options = &options
+	return q
+}
+
+func runServe(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("serve", stderr)
+	var c config
+	registerSettings(fs, &c)
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if c.port == 0 {
+		c.port = 8080
+	}
+	return serveOn(c.port)
+}
+
+func serveOn(port int) int {
+	if e := startServer(port); e != nil {
+		logger.Printf("ERROR: Server failed: %v", e)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("validate", stderr)
+	if code, ok := parseFlags(fs, nil, args, stderr); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	code := exitOK
+	for _, path := range fs.Args() {
+		x, e := compileXpath(path)
+		if e != nil {
+			fmt.Fprintf(stdout, "%s: invalid: %v\n", path, e)
+			code = exitFailure
+			continue
+		}
+		x.expr.Free()
+		fmt.Fprintf(stdout, "%s: ok\n", path)
+	}
+	return code
+}
+
+func runConfig(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "print" {
+		newFlagSet("config", stderr).Usage()
+		return exitUsage
+	}
+	fs := newFlagSet("config", stderr)
+	var c config
+	registerSettings(fs, &c)
+	format := fs.String("format", "json", "Print the configuration as json or toml")
+	if code, ok := parseFlags(fs, &c, args[1:], stderr); !ok {
+		return code
+	}
+	if *format != "json" && *format != "toml" {
+		fs.Usage()
+		return exitUsage
+	}
+	if e := printConfig(stdout, fs, *format); e != nil {
+		fmt.Fprintf(stderr, "getxpath config: %v\n", e)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func runVersion(args []string, stdout, stderr io.Writer) int {
+	version := status.Version
+	if version == "" {
+		version = "unknown"
+	}
+	fmt.Fprintf(stdout, "getxpath %s %s\n", version, status.GoVersion)
+	return exitOK
+}
+
+// runLegacy keeps the flag-only invocation working, as in
+// 'getxpath -port=$PORT' or 'getxpath -url=... -xpath=...'.
+func runLegacy(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("getxpath", stderr)
+	var c config
+	url := fs.String("url", "", "URL to fetch")
+	xpath := fs.String("xpath", "", "XPath to extract from the document at <url>")
+	registerLocalSettings(fs, &c)
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if c.port > 0 {
+		// Serving, the SSRF protection is on as for 'getxpath serve'
+		// unless turned off.
+		set := false
+		fs.Visit(func(f *flag.Flag) { set = set || f.Name == "ssrf-protection" })
+		if !set {
+			guard.enabled = true
+		}
+		return serveOn(c.port)
+	}
+	if *url != "" && *xpath != "" {
+		enableLocalFiles(true)
+		return extractOne(query{URL: *url, Xpath: *xpath}, false, stdout, stderr)
+	}
+	printUsage(stderr)
+	return exitUsage
+}
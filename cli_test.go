@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func runTestCommand(args ...string) (int, string, string) {
+	defer logger.SetOutput(os.Stdout)
+	var stdout, stderr bytes.Buffer
+	code := runCommand(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func newCLITestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testPage)
+	}))
+}
+
+func TestGetCommand(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, stdout, stderr := runTestCommand("get", server.URL, "//title")
+	if code != exitOK || stdout != "Cached Page\n" {
+		t.Errorf("Got exit code %d and output '%s' (%s)", code, stdout, stderr)
+	}
+}
+
+func TestGetCommandSSRFProtectionIsOptIn(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, _, stderr := runTestCommand("get", "-ssrf-protection", server.URL, "//title")
+	if code != exitFailure || !strings.Contains(stderr, "forbidden") {
+		t.Errorf("Got exit code %d and '%s', wanted the loopback address to be forbidden", code, stderr)
+	}
+}
+
+func TestGetCommandJSONOutputWithError(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, stdout, stderr := runTestCommand("get", "-output", "json", server.URL, "//blink")
+	if code != exitFailure {
+		t.Errorf("Got exit code %d, wanted %d", code, exitFailure)
+	}
+	var res map[string]interface{}
+	if e := json.Unmarshal([]byte(stdout), &res); e != nil {
+		t.Fatalf("Expected JSON output, got '%s': %v", stdout, e)
+	}
+	if res["error"] != "Xpath not found" || !strings.Contains(stderr, "Xpath not found") {
+		t.Errorf("Got '%s' and '%s'", stdout, stderr)
+	}
+}
+
+func TestLegacyFlags(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, stdout, _ := runTestCommand("-url", server.URL, "-xpath", "//title")
+	if code != exitOK || stdout != "Cached Page\n" {
+		t.Errorf("Got exit code %d and output '%s'", code, stdout)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	code, stdout, _ := runTestCommand("validate", "//title", "//title[")
+	if code != exitFailure {
+		t.Errorf("Got exit code %d, wanted %d", code, exitFailure)
+	}
+	if !strings.Contains(stdout, "//title: ok") || !strings.Contains(stdout, "//title[: invalid") {
+		t.Errorf("Got '%s'", stdout)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	for _, args := range [][]string{{}, {"frobnicate"}, {"get", "http://example.com"}, {"get", "-no-such-flag"}, {"serve", "-host-rate", "-1"}} {
+		func() {
+			defer saveSettings()()
+			if code, _, _ := runTestCommand(args...); code != exitUsage {
+				t.Errorf("Got exit code %d for %v, wanted %d", code, args, exitUsage)
+			}
+		}()
+	}
+}
+
+func TestHelpExitsCleanly(t *testing.T) {
+	code, _, stderr := runTestCommand("get", "-h")
+	if code != exitOK || !strings.Contains(stderr, "Usage: getxpath get") {
+		t.Errorf("Got exit code %d and '%s'", code, stderr)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	code, stdout, _ := runTestCommand("version")
+	if code != exitOK || !strings.HasPrefix(stdout, "getxpath ") {
+		t.Errorf("Got exit code %d and '%s'", code, stdout)
+	}
+}
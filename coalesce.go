@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var fetches = &flightGroup{}
+
+type coalescingStats struct {
+	// Fetches counts requests that shared another request's upstream fetch.
+	Fetches int64
+	// Parses counts requests that shared another request's document parse.
+	Parses int64
+}
+
+func coalescing() coalescingStats {
+	return coalescingStats{
+		Fetches: atomic.LoadInt64(&fetches.coalesced),
+		Parses:  documents.coalescedParses(),
+	}
+}
+
+// flightCall is an in-progress or completed call of flightGroup.do.
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	dups int
+}
+
+// flightGroup runs a function once per key for all concurrent callers.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+
+	coalesced int64
+}
+
+// do executes fn for key unless a call for key is already in flight, in
+// which case it shares that call, and returns its results unless ctx ends
+// first. shared tells whether the results were delivered to more than one
+// caller.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		atomic.AddInt64(&g.coalesced, 1)
+		select {
+		case <-c.done:
+			return c.val, c.err, true
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// fn runs on its own, so that the first caller too can stop waiting
+	// for it while the others still get its results.
+	go func() {
+		c.val, c.err = fn()
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+
+	g.mu.Lock()
+	shared = c.dups > 0
+	g.mu.Unlock()
+	return c.val, c.err, shared
+}
+
+// readBodyCoalesced is readBodyFromURL shared between concurrent callers
+// asking for the same URL with the same request headers and fetch checks.
+func readBodyCoalesced(ctx context.Context, url string, header http.Header) (*upstreamResponse, error) {
+	key := fetchKey(url, header) + "\n" + fetchChecksFrom(ctx).key()
+	v, e, _ := fetches.do(ctx, key, func() (interface{}, error) {
+		shared, cancel := sharedContext(ctx)
+		defer cancel()
+		return readBodyFromURL(shared, url, header)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return v.(*upstreamResponse), nil
+}
+
+// sharedContext keeps the values and the deadline of ctx but not its
+// cancelation, for a fetch shared with other requests, which should not fail
+// because the client that started it went away.
+func sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detachedContext{ctx}, deadline)
+	}
+	return context.WithCancel(detachedContext{ctx})
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func fetchKey(url string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := []string{url}
+	for _, name := range names {
+		key = append(key, name+": "+strings.Join(header[name], ", "))
+	}
+	return strings.Join(key, "\n")
+}
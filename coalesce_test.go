@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentFetchesAreCoalesced(t *testing.T) {
+	defer allowLoopback()()
+	fetches = &flightGroup{}
+	var requests int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		<-release
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	const clients = 8
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, e := readBodyCoalesced(context.Background(), server.URL, http.Header{})
+			if e != nil || string(resp.Body) != testPage {
+				t.Errorf("Got (%v, %v), wanted the test page", resp, e)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return coalescing().Fetches == clients-1 })
+	close(release)
+	wg.Wait()
+
+	if requests != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", requests)
+	}
+}
+
+func TestFetchKeyDependsOnHeaders(t *testing.T) {
+	plain := fetchKey("http://example.com", http.Header{})
+	conditional := fetchKey("http://example.com", http.Header{"If-None-Match": {`"v1"`}})
+	if plain == conditional {
+		t.Errorf("Expected different keys for different request headers")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescedCallersStopWaitingWhenTheirContextEnds(t *testing.T) {
+	group := &flightGroup{}
+	release := make(chan struct{})
+	leader := make(chan error)
+	go func() {
+		_, e, _ := group.do(context.Background(), "key", func() (interface{}, error) {
+			<-release
+			return "done", nil
+		})
+		leader <- e
+	}()
+	waitFor(t, func() bool {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		return len(group.calls) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, e, _ := group.do(ctx, "key", nil); e != context.DeadlineExceeded {
+		t.Errorf("Got %v, wanted the deadline of the waiting caller", e)
+	}
+	first, cancelFirst := context.WithCancel(context.Background())
+	cancelFirst()
+	if _, e, _ := group.do(first, "other", func() (interface{}, error) {
+		<-release
+		return "done", nil
+	}); e != context.Canceled {
+		t.Errorf("Got %v, wanted the first caller to stop waiting too", e)
+	}
+	close(release)
+	if e := <-leader; e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+}
+
+func TestSharedContextIgnoresCancelation(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Minute)
+	shared, done := sharedContext(ctx)
+	defer done()
+	cancel()
+
+	if shared.Err() != nil || shared.Value(key{}) != "value" {
+		t.Errorf("Got %v and %v, wanted no error and the value", shared.Err(), shared.Value(key{}))
+	}
+	if _, ok := shared.Deadline(); !ok {
+		t.Errorf("Expected the deadline to be kept")
+	}
+}
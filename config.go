@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// envPrefix prefixes the environment variables overriding settings, e.g.
+// GETXPATH_CACHE_ENTRIES for -cache-entries.
+const envPrefix = "GETXPATH_"
+
+// Settings not read from config files or the environment.
+var commandLineOnly = map[string]bool{"config": true, "url": true, "xpath": true, "format": true}
+
+var (
+	timezone     = "CET"
+	fetchRetries = 3
+)
+
+// config holds the settings that are not written straight into the
+// subsystem they configure but need parsing or loading first.
+type config struct {
+	file string
+	port int
+
+	allowCIDRs  string
+	denyCIDRs   string
+	allowHosts  string
+	denyHosts   string
+	corsOrigins string
+	corsHeaders string
+
+	apiKeysFile    string
+	policiesFile   string
+	hostLimitsFile string
+	fileRoot       string
+}
+
+// registerSettings defines a flag for every setting on fs.
+func registerSettings(fs *flag.FlagSet, c *config) {
+	fs.StringVar(&c.file, "config", os.Getenv(envPrefix+"CONFIG"), "JSON or TOML (.toml) file with settings, overridden by "+envPrefix+"* environment variables and flags")
+	fs.IntVar(&c.port, "port", 0, "Port in server mode")
+	fs.StringVar(&timezone, "timezone", timezone, "Time zone of times shown in /_status")
+	fs.IntVar(&fetchRetries, "fetch-retries", fetchRetries, "Number of times a failed fetch is retried")
+	fs.DurationVar(&httpClient.Timeout, "fetch-timeout", httpClient.Timeout, "Maximum duration of fetching a page, including redirects and reading the body")
+
+	fs.IntVar(&bodyCache.maxEntries, "cache-entries", bodyCache.maxEntries, "Maximum number of pages kept in the response cache (0 disables caching)")
+	fs.Int64Var(&bodyCache.maxBytes, "cache-bytes", bodyCache.maxBytes, "Maximum total size in bytes of the pages kept in the response cache")
+	fs.Int64Var(&documents.maxBytes, "document-cache-bytes", documents.maxBytes, "Estimated memory in bytes that parsed documents may occupy in the document cache")
+	fs.IntVar(&expressions.maxEntries, "xpath-cache-entries", expressions.maxEntries, "Maximum number of compiled XPaths kept for reuse (0 disables caching)")
+
+	fs.Float64Var(&hosts.defaults.Rate, "host-rate", hosts.defaults.Rate, "Requests per second sent to a single host (0 for no limit)")
+	fs.IntVar(&hosts.defaults.Burst, "host-burst", hosts.defaults.Burst, "Requests that may be sent to a single host at once after idling")
+	fs.IntVar(&hosts.defaults.Concurrency, "host-concurrency", hosts.defaults.Concurrency, "Concurrent connections to a single host (0 for no limit)")
+	fs.StringVar(&c.hostLimitsFile, "host-limits", "", "JSON file with per-domain rate, burst and concurrency overrides")
+	fs.Int64Var(&maxDocumentSize, "max-document-bytes", maxDocumentSize, "Maximum size in bytes of documents posted to /extract")
+	fs.StringVar(&c.fileRoot, "file-root", "", "Directory whose files may be read with file:// URLs in server mode (none without)")
+	fs.BoolVar(&enforceRobots, "robots", enforceRobots, "Refuse to fetch URLs disallowed by robots.txt for all queries")
+
+	fs.BoolVar(&guard.enabled, "ssrf-protection", guard.enabled, "Refuse to fetch from private, loopback, link-local and other reserved addresses")
+	fs.StringVar(&c.allowCIDRs, "allow-cidrs", "", "Comma separated networks that may be fetched from despite being reserved")
+	fs.StringVar(&c.denyCIDRs, "deny-cidrs", "", "Comma separated networks that may never be fetched from")
+	fs.StringVar(&c.allowHosts, "allow-hosts", "", "Comma separated host globs that may be fetched from despite resolving to reserved addresses")
+	fs.StringVar(&c.denyHosts, "deny-hosts", "", "Comma separated host globs that may never be fetched from")
+
+	fs.StringVar(&c.apiKeysFile, "api-keys", "", "JSON file with the API clients, their keys, scopes and quotas (no authentication without)")
+	fs.StringVar(&c.policiesFile, "policies", "", "JSON file with the URL policies per API key, reloaded when changed")
+	fs.StringVar(&c.corsOrigins, "cors-origins", "", "Comma separated origins (globs like https://*.example.com, or *) allowed to call the server from browsers")
+	fs.StringVar(&c.corsHeaders, "cors-headers", strings.Join(cors.allowedHeaders, ","), "Comma separated request headers allowed in cross-origin requests")
+	fs.BoolVar(&cors.allowCredentials, "cors-credentials", cors.allowCredentials, "Allow cross-origin requests with credentials")
+	fs.BoolVar(&jsonpEnabled, "jsonp", jsonpEnabled, "Wrap /get results in the function named by the callback parameter")
+
+	fs.DurationVar(&serverSettings.readTimeout, "read-timeout", serverSettings.readTimeout, "Maximum duration for reading a request")
+	fs.DurationVar(&serverSettings.writeTimeout, "write-timeout", serverSettings.writeTimeout, "Maximum duration for handling a request and writing its response")
+	fs.DurationVar(&serverSettings.idleTimeout, "idle-timeout", serverSettings.idleTimeout, "Maximum duration a keep-alive connection may idle")
+	fs.IntVar(&serverSettings.maxHeaderBytes, "max-header-bytes", serverSettings.maxHeaderBytes, "Maximum size in bytes of request headers")
+	fs.DurationVar(&serverSettings.drainDelay, "drain-delay", serverSettings.drainDelay, "Time to keep serving while reporting not ready after SIGTERM")
+	fs.DurationVar(&serverSettings.shutdownTimeout, "shutdown-timeout", serverSettings.shutdownTimeout, "Time in-flight requests get to finish on shutdown")
+	fs.BoolVar(&selfTestOnReady, "ready-self-test", selfTestOnReady, "Run a self-test extraction on every /readyz check")
+	fs.IntVar(&extractions.maxInFlight, "max-in-flight", extractions.maxInFlight, "Maximum number of /get requests handled at once (0 for no limit)")
+	fs.IntVar(&extractions.maxQueue, "max-queue", extractions.maxQueue, "Maximum number of /get requests waiting for a slot before new ones are shed")
+	fs.DurationVar(&extractions.queueTimeout, "queue-timeout", extractions.queueTimeout, "Maximum time a /get request waits for a slot before it is shed")
+}
+
+// loadConfig completes the settings of fs, which must have been set up
+// with registerSettings and parsed. Settings come from, in increasing
+// precedence, their defaults, the config file, GETXPATH_* environment
+// variables and the command line.
+func loadConfig(fs *flag.FlagSet, c *config) error {
+	fromCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { fromCommandLine[f.Name] = true })
+
+	if c.file != "" {
+		values, e := readConfigFile(c.file)
+		if e != nil {
+			return fmt.Errorf("Config file %s: %v", c.file, e)
+		}
+		for name, value := range values {
+			if fs.Lookup(name) == nil || commandLineOnly[name] {
+				return fmt.Errorf("Config file %s: unknown setting %q", c.file, name)
+			}
+			if fromCommandLine[name] {
+				continue
+			}
+			if e := fs.Set(name, value); e != nil {
+				return fmt.Errorf("Config file %s: invalid value %q for %s: %v", c.file, value, name, e)
+			}
+		}
+	}
+
+	var e error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || e != nil || fromCommandLine[f.Name] || commandLineOnly[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			e = fmt.Errorf("Invalid value %q for %s: %v", value, envName(f.Name), err)
+		}
+	})
+	if e != nil {
+		return e
+	}
+
+	return c.apply()
+}
+
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(setting, "-", "_", -1))
+}
+
+// readConfigFile reads the settings of a TOML file, for the extension
+// .toml, or else of a JSON object. Values may be strings, numbers, booleans
+// or, for comma separated lists, arrays.
+func readConfigFile(path string) (map[string]string, error) {
+	bytez, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		return parseTOMLSettings(string(bytez))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bytez))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if e := decoder.Decode(&raw); e != nil {
+		return nil, e
+	}
+
+	values := make(map[string]string)
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case json.Number, bool:
+			values[name] = fmt.Sprint(v)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("unsupported value %v for %s", v, name)
+		}
+	}
+	return values, nil
+}
+
+// apply validates the settings and hands them to their subsystems.
+func (c *config) apply() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.port < 0 || c.port > 65535 {
+		invalid("port must be between 0 and 65535, not %d", c.port)
+	}
+	if loc, e := time.LoadLocation(timezone); e != nil {
+		invalid("timezone %q is unknown: %v", timezone, e)
+	} else {
+		status.DeployedAt = status.DeployedAt.In(loc)
+	}
+	if fetchRetries < 0 {
+		invalid("fetch-retries must not be negative")
+	}
+	if maxDocumentSize <= 0 {
+		invalid("max-document-bytes must be positive")
+	}
+	if bodyCache.maxBytes < 0 || documents.maxBytes < 0 || expressions.maxEntries < 0 {
+		invalid("cache sizes must not be negative")
+	}
+	if hosts.defaults.Rate < 0 || hosts.defaults.Burst < 0 || hosts.defaults.Concurrency < 0 {
+		invalid("host-rate, host-burst and host-concurrency must not be negative")
+	}
+	if extractions.maxInFlight < 0 || extractions.maxQueue < 0 {
+		invalid("max-in-flight and max-queue must not be negative")
+	}
+
+	var e error
+	if guard.allowNets, e = parseCIDRList(c.allowCIDRs); e != nil {
+		invalid("allow-cidrs: %v", e)
+	}
+	if guard.denyNets, e = parseCIDRList(c.denyCIDRs); e != nil {
+		invalid("deny-cidrs: %v", e)
+	}
+	guard.allowHosts = splitList(c.allowHosts)
+	guard.denyHosts = splitList(c.denyHosts)
+	cors.allowedOrigins = splitList(c.corsOrigins)
+	cors.allowedHeaders = strings.Split(strings.Replace(c.corsHeaders, " ", "", -1), ",")
+
+	if c.fileRoot != "" {
+		if localFiles.root, e = resolveRoot(c.fileRoot); e != nil {
+			invalid("file-root: %v", e)
+		}
+		localFiles.enabled = true
+	}
+
+	if c.apiKeysFile != "" {
+		if e := auth.load(c.apiKeysFile); e != nil {
+			invalid("Could not load API keys from %s: %v", c.apiKeysFile, e)
+		}
+	}
+	if c.policiesFile != "" {
+		if e := policies.load(c.policiesFile); e != nil {
+			invalid("Could not load policies from %s: %v", c.policiesFile, e)
+		}
+	}
+	if c.hostLimitsFile != "" {
+		if e := hosts.watchOverrides(c.hostLimitsFile); e != nil {
+			invalid("Could not load host limits from %s: %v", c.hostLimitsFile, e)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// printConfig writes the effective settings of fs as a JSON object that can
+// be used as a config file.
+func printConfig(w io.Writer, fs *flag.FlagSet, format string) error {
+	values := make(map[string]interface{})
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly[f.Name] {
+			return
+		}
+		var v interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			v = getter.Get()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		values[f.Name] = v
+	})
+
+	if format == "toml" {
+		return writeTOMLSettings(w, values)
+	}
+	// Maps are marshalled with sorted keys.
+	bytes, e := json.MarshalIndent(values, "", "  ")
+	if e != nil {
+		return e
+	}
+	_, e = fmt.Fprintf(w, "%s\n", bytes)
+	return e
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// saveSettings returns a function restoring the globals that loading a
+// config changes.
+func saveSettings() func() {
+	savedGuard, savedCORS := *guard, *cors
+	savedLimit, savedEntries := hosts.defaults, bodyCache.maxEntries
+	savedRetries, savedTimezone := fetchRetries, timezone
+	savedLocalFiles := localFiles
+	return func() {
+		localFiles = savedLocalFiles
+		guard.enabled, guard.allowNets, guard.denyNets = savedGuard.enabled, savedGuard.allowNets, savedGuard.denyNets
+		guard.allowHosts, guard.denyHosts = savedGuard.allowHosts, savedGuard.denyHosts
+		cors.allowedOrigins, cors.allowedHeaders = savedCORS.allowedOrigins, savedCORS.allowedHeaders
+		hosts.defaults, bodyCache.maxEntries = savedLimit, savedEntries
+		fetchRetries, timezone = savedRetries, savedTimezone
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	return writeNamedConfigFile(t, "config.json", content)
+}
+
+func writeNamedConfigFile(t *testing.T, name string, content string) string {
+	dir, e := ioutil.TempDir("", "getxpath-config")
+	if e != nil {
+		t.Fatal(e)
+	}
+	path := filepath.Join(dir, name)
+	if e := ioutil.WriteFile(path, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return path
+}
+
+func loadTestConfig(args ...string) (*flag.FlagSet, config, error) {
+	fs := flag.NewFlagSet("getxpath", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var c config
+	registerSettings(fs, &c)
+	if e := fs.Parse(args); e != nil {
+		return fs, c, e
+	}
+	e := loadConfig(fs, &c)
+	return fs, c, e
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	defer saveSettings()()
+	path := writeConfigFile(t, `{"port": 8080, "host-rate": 2, "cache-entries": 10, "fetch-retries": 1, "cors-origins": ["https://a.example.com", "https://b.example.com"]}`)
+	os.Setenv("GETXPATH_CACHE_ENTRIES", "20")
+	os.Setenv("GETXPATH_FETCH_RETRIES", "2")
+	defer os.Unsetenv("GETXPATH_CACHE_ENTRIES")
+	defer os.Unsetenv("GETXPATH_FETCH_RETRIES")
+
+	_, c, e := loadTestConfig("-config", path, "-fetch-retries", "5")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if c.port != 8080 || hosts.defaults.Rate != 2 {
+		t.Errorf("Expected the config file to override defaults, got port %d and host-rate %v", c.port, hosts.defaults.Rate)
+	}
+	if bodyCache.maxEntries != 20 {
+		t.Errorf("Expected the environment to override the config file, got cache-entries %d", bodyCache.maxEntries)
+	}
+	if fetchRetries != 5 {
+		t.Errorf("Expected flags to override the environment, got fetch-retries %d", fetchRetries)
+	}
+	if len(cors.allowedOrigins) != 2 || cors.allowedOrigins[1] != "https://b.example.com" {
+		t.Errorf("Expected the list from the config file, got %v", cors.allowedOrigins)
+	}
+}
+
+func TestConfigRejectsUnknownSettings(t *testing.T) {
+	defer saveSettings()()
+	path := writeConfigFile(t, `{"cache-entrys": 10}`)
+
+	_, _, e := loadTestConfig("-config", path)
+	if e == nil || !strings.Contains(e.Error(), `unknown setting "cache-entrys"`) {
+		t.Errorf("Expected an error about the unknown setting, got %v", e)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	defer saveSettings()()
+	os.Setenv("GETXPATH_TIMEZONE", "Mars/Olympus_Mons")
+	defer os.Unsetenv("GETXPATH_TIMEZONE")
+
+	_, _, e := loadTestConfig("-host-rate", "-1", "-deny-cidrs", "10.0.0.0/33")
+	if e == nil {
+		t.Fatal("Expected an invalid configuration")
+	}
+	for _, problem := range []string{"timezone", "host-rate", "deny-cidrs"} {
+		if !strings.Contains(e.Error(), problem) {
+			t.Errorf("Expected %s to be reported in '%v'", problem, e)
+		}
+	}
+}
+
+func TestConfigInvalidEnvironmentValue(t *testing.T) {
+	defer saveSettings()()
+	os.Setenv("GETXPATH_HOST_BURST", "many")
+	defer os.Unsetenv("GETXPATH_HOST_BURST")
+
+	_, _, e := loadTestConfig()
+	if e == nil || !strings.Contains(e.Error(), "GETXPATH_HOST_BURST") {
+		t.Errorf("Expected an error naming the variable, got %v", e)
+	}
+}
+
+func TestPrintConfigRoundTrips(t *testing.T) {
+	defer saveSettings()()
+	fs, _, e := loadTestConfig("-host-rate", "2.5", "-queue-timeout", "3s")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var buf bytes.Buffer
+	if e := printConfig(&buf, fs, "json"); e != nil {
+		t.Fatal(e)
+	}
+	var printed map[string]interface{}
+	if e := json.Unmarshal(buf.Bytes(), &printed); e != nil {
+		t.Fatal(e)
+	}
+	if printed["host-rate"] != 2.5 || printed["queue-timeout"] != "3s" {
+		t.Errorf("Got %s", buf.String())
+	}
+	if _, ok := printed["config"]; ok {
+		t.Errorf("Expected command line only settings to be left out")
+	}
+
+	path := writeConfigFile(t, buf.String())
+	if _, _, e := loadTestConfig("-config", path); e != nil {
+		t.Errorf("Expected the printed config to be loadable, got %v", e)
+	}
+}
+
+func TestTOMLConfigFile(t *testing.T) {
+	defer saveSettings()()
+	path := writeNamedConfigFile(t, "config.toml", `# getxpath
+port = 8080
+host-rate = 2
+timezone = "Europe/Berlin"
+cors-origins = ["https://a.example.com", 'https://b.example.com']
+`)
+	_, c, e := loadTestConfig("-config", path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if c.port != 8080 || hosts.defaults.Rate != 2 || timezone != "Europe/Berlin" || c.corsOrigins != "https://a.example.com,https://b.example.com" {
+		t.Errorf("Got port %d, host-rate %v, timezone %s and cors-origins %s", c.port, hosts.defaults.Rate, timezone, c.corsOrigins)
+	}
+
+	fs, _, e := loadTestConfig("-host-rate", "2.5", "-queue-timeout", "3s")
+	if e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	if e := printConfig(&buf, fs, "toml"); e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(buf.String(), "host-rate = 2.5\n") || !strings.Contains(buf.String(), `queue-timeout = "3s"`) {
+		t.Errorf("Got %s", buf.String())
+	}
+	if _, _, e := loadTestConfig("-config", writeNamedConfigFile(t, "printed.toml", buf.String())); e != nil {
+		t.Errorf("Expected the printed config to be loadable, got %v", e)
+	}
+}
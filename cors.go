@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cors = &corsConfig{
+	allowedHeaders: []string{"Content-Type", "X-API-Key"},
+	maxAge:         10 * time.Minute,
+}
+
+// jsonpEnabled allows wrapping /get results in the function named by the
+// callback parameter.
+var jsonpEnabled = false
+
+// corsConfig are the cross-origin requests browsers may make. Origins are
+// globs like https://*.example.com, or * for any origin.
+type corsConfig struct {
+	allowedOrigins   []string
+	allowedHeaders   []string
+	allowCredentials bool
+	maxAge           time.Duration
+}
+
+func (c *corsConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.allowedOrigins {
+		if allowed == "*" || originMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches compares the scheme and port of an origin with those of the
+// allowed origin and its host with the allowed host glob, in which * may
+// stand for any number of labels.
+func originMatches(allowed string, origin string) bool {
+	a, e := neturl.Parse(allowed)
+	if e != nil {
+		return false
+	}
+	o, e := neturl.Parse(origin)
+	if e != nil || o.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(a.Scheme, o.Scheme) || a.Port() != o.Port() {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(a.Hostname()), strings.ToLower(o.Hostname()))
+	return ok
+}
+
+// withCORS adds the CORS headers for allowed origins and answers preflight
+// requests itself, before authentication, as browsers send no API key with
+// them.
+func withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		header := writer.Header()
+		if len(cors.allowedOrigins) > 0 {
+			// Responses differ by origin, also those without CORS
+			// headers, which caches must not hand to allowed origins.
+			header.Add("Vary", "Origin")
+		}
+		origin := req.Header.Get("Origin")
+		if origin == "" || !cors.allowsOrigin(origin) {
+			handler(writer, req)
+			return
+		}
+
+		if containsString(cors.allowedOrigins, "*") && !cors.allowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.allowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", strings.Join(cors.allowedHeaders, ", "))
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.maxAge.Seconds())))
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*(\.[A-Za-z_$][0-9A-Za-z_$]*)*$`)
+
+const maxJSONPCallbackLength = 128
+
+func jsonpFormat(callback string) (resultFormat, error) {
+	if !jsonpEnabled {
+		return resultFormats[0], fmt.Errorf("JSONP is not enabled on this server.")
+	}
+	if len(callback) > maxJSONPCallbackLength || !jsonpCallbackPattern.MatchString(callback) {
+		return resultFormats[0], fmt.Errorf("callback must be a JavaScript identifier, optionally with dots.")
+	}
+	return resultFormat{
+		name:        "jsonp",
+		mediaType:   "application/javascript",
+		contentType: "application/javascript; charset=utf-8",
+		encode: func(w io.Writer, res response) error {
+			bytes, e := json.Marshal(res)
+			if e != nil {
+				return e
+			}
+			// The leading comment guards against content sniffing attacks.
+			_, e = fmt.Fprintf(w, "/**/ typeof %s === 'function' && %s(%s);", callback, callback, bytes)
+			return e
+		},
+	}, nil
+}
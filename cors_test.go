@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins []string) { cors.allowedOrigins = origins }(cors.allowedOrigins)
+	cors.allowedOrigins = []string{"https://*.example.com"}
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected the preflight request to be answered by withCORS")
+	})
+
+	req, _ := http.NewRequest("OPTIONS", "/get", nil)
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Got status %d, wanted 204", recorder.Code)
+	}
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "https://dashboard.example.com" {
+		t.Errorf("Got Access-Control-Allow-Origin '%v'", origin)
+	}
+	if headers := recorder.Header().Get("Access-Control-Allow-Headers"); headers != "Content-Type, X-API-Key" {
+		t.Errorf("Got Access-Control-Allow-Headers '%v'", headers)
+	}
+}
+
+func TestCORSIgnoresOtherOrigins(t *testing.T) {
+	defer func(origins []string) { cors.allowedOrigins = origins }(cors.allowedOrigins)
+	cors.allowedOrigins = []string{"https://*.example.com"}
+	called := false
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req, _ := http.NewRequest("GET", "/get", nil)
+	req.Header.Set("Origin", "https://evil.example.org")
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+
+	if !called || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected the request to be passed on without CORS headers")
+	}
+}
+
+func TestCORSVariesByOriginForEveryResponse(t *testing.T) {
+	defer func(origins []string) { cors.allowedOrigins = origins }(cors.allowedOrigins)
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, origin := range []string{"", "https://evil.example.org", "https://dashboard.example.com"} {
+		req, _ := http.NewRequest("GET", "/get", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		cors.allowedOrigins = []string{"https://*.example.com"}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if vary := recorder.Header()["Vary"]; len(vary) != 1 || vary[0] != "Origin" {
+			t.Errorf("Got Vary %v for origin '%s', wanted Origin", vary, origin)
+		}
+
+		cors.allowedOrigins = nil
+		recorder = httptest.NewRecorder()
+		handler(recorder, req)
+		if vary := recorder.Header().Get("Vary"); vary != "" {
+			t.Errorf("Got Vary '%s' without CORS", vary)
+		}
+	}
+}
+
+func TestCORSOriginMatching(t *testing.T) {
+	c := &corsConfig{allowedOrigins: []string{"https://*.example.com", "http://localhost:3000"}}
+	for origin, allowed := range map[string]bool{
+		"https://dashboard.example.com":      true,
+		"https://a.b.example.com":            true,
+		"HTTPS://Dashboard.Example.com":      true,
+		"https://example.com":                false,
+		"http://dashboard.example.com":       false,
+		"https://dashboard.example.com:8443": false,
+		"https://example.com.evil.org":       false,
+		"http://localhost:3000":              true,
+		"http://localhost:3001":              false,
+	} {
+		if c.allowsOrigin(origin) != allowed {
+			t.Errorf("Got allowsOrigin(%s) = %v, wanted %v", origin, !allowed, allowed)
+		}
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	defer func(origins []string) { cors.allowedOrigins = origins }(cors.allowedOrigins)
+	cors.allowedOrigins = []string{"*"}
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {})
+
+	req, _ := http.NewRequest("GET", "/get", nil)
+	req.Header.Set("Origin", "https://anywhere.example.org")
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Got Access-Control-Allow-Origin '%v', wanted *", origin)
+	}
+}
+
+func TestJSONPCallbackValidation(t *testing.T) {
+	defer func(enabled bool) { jsonpEnabled = enabled }(jsonpEnabled)
+	jsonpEnabled = true
+
+	for callback, valid := range map[string]bool{
+		"handle":             true,
+		"app.results.handle": true,
+		"$_cb1":              true,
+		"alert(1)//":         false,
+		"a..b":               false,
+		"1abc":               false,
+		"a b":                false,
+	} {
+		if _, e := jsonpFormat(callback); (e == nil) != valid {
+			t.Errorf("Got jsonpFormat(%v) error %v, wanted valid = %v", callback, e, valid)
+		}
+	}
+}
+
+func TestJSONPResponse(t *testing.T) {
+	defer func(enabled bool) { jsonpEnabled = enabled }(jsonpEnabled)
+	jsonpEnabled = true
+
+	format, _ := jsonpFormat("handle")
+	recorder := httptest.NewRecorder()
+	writeResult(recorder, format, 400, result{Error: "oops"})
+
+	expected := `/**/ typeof handle === 'function' && handle({"query":null,"result":"","error":"oops"});`
+	if recorder.Code != 200 || recorder.Body.String() != expected {
+		t.Errorf("Got %d '%v'", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// cssToXpath translates a CSS selector into an XPath. It supports type,
+// universal, id, class and attribute selectors, the descendant, child and
+// sibling combinators, selector groups and the :first-child, :last-child,
+// :only-child, :nth-child() and :not() pseudo-classes.
+func cssToXpath(selector string) (string, error) {
+	p := &cssParser{input: selector}
+	var xpaths []string
+	for {
+		xpath, e := p.parseSelector()
+		if e != nil {
+			return "", e
+		}
+		xpaths = append(xpaths, xpath)
+		p.skipSpace()
+		if p.done() {
+			return strings.Join(xpaths, " | "), nil
+		}
+		if !p.consume(',') {
+			return "", p.errorf("expected , or end of selector")
+		}
+	}
+}
+
+type cssParser struct {
+	input string
+	pos   int
+}
+
+func (p *cssParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid CSS selector at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *cssParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *cssParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *cssParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cssParser) skipSpace() bool {
+	start := p.pos
+	for !p.done() && strings.IndexByte(" \t\n\r\f", p.peek()) >= 0 {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+// parseSelector parses compound selectors joined by combinators.
+func (p *cssParser) parseSelector() (string, error) {
+	p.skipSpace()
+	xpath := "//"
+	for {
+		step, e := p.parseCompound()
+		if e != nil {
+			return "", e
+		}
+		xpath += step
+
+		space := p.skipSpace()
+		switch c := p.peek(); {
+		case c == ',' || c == ')' || p.done():
+			return xpath, nil
+		case c == '>':
+			p.pos++
+			xpath += "/"
+		case c == '+':
+			p.pos++
+			xpath += "/following-sibling::*[1]/self::"
+		case c == '~':
+			p.pos++
+			xpath += "/following-sibling::"
+		case space:
+			xpath += "//"
+		default:
+			return "", p.errorf("unexpected %q", c)
+		}
+		p.skipSpace()
+	}
+}
+
+// parseCompound parses a type or universal selector followed by id, class,
+// attribute and pseudo-class selectors, returning an XPath step.
+func (p *cssParser) parseCompound() (string, error) {
+	name, explicit := "*", true
+	if p.consume('*') {
+	} else if isCSSNameByte(p.peek()) {
+		name = strings.ToLower(p.parseName())
+	} else {
+		explicit = false
+	}
+
+	var predicates []string
+	for {
+		var predicate string
+		var e error
+		switch p.peek() {
+		case '#':
+			p.pos++
+			id := p.parseName()
+			if id == "" {
+				return "", p.errorf("expected id after #")
+			}
+			predicate = "@id=" + xpathLiteral(id)
+		case '.':
+			p.pos++
+			class := p.parseName()
+			if class == "" {
+				return "", p.errorf("expected class name after .")
+			}
+			predicate = containsToken("@class", class)
+		case '[':
+			p.pos++
+			predicate, e = p.parseAttribute()
+		case ':':
+			p.pos++
+			predicate, e = p.parsePseudo()
+		default:
+			if !explicit && len(predicates) == 0 {
+				return "", p.errorf("expected selector")
+			}
+			step := name
+			for _, predicate := range predicates {
+				step += "[" + predicate + "]"
+			}
+			return step, nil
+		}
+		if e != nil {
+			return "", e
+		}
+		predicates = append(predicates, predicate)
+	}
+}
+
+func isCSSNameByte(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func (p *cssParser) parseName() string {
+	start := p.pos
+	for !p.done() && isCSSNameByte(p.peek()) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *cssParser) parseAttribute() (string, error) {
+	p.skipSpace()
+	name := strings.ToLower(p.parseName())
+	if name == "" {
+		return "", p.errorf("expected attribute name")
+	}
+	attr := "@" + name
+	p.skipSpace()
+	if p.consume(']') {
+		return attr, nil
+	}
+
+	var op string
+	for _, candidate := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if strings.HasPrefix(p.input[p.pos:], candidate) {
+			op = candidate
+		}
+	}
+	if op == "" {
+		return "", p.errorf("expected attribute operator or ]")
+	}
+	p.pos += len(op)
+	p.skipSpace()
+	value, e := p.parseValue()
+	if e != nil {
+		return "", e
+	}
+	p.skipSpace()
+	if !p.consume(']') {
+		return "", p.errorf("expected ]")
+	}
+
+	literal := xpathLiteral(value)
+	switch op {
+	case "~=":
+		return containsToken(attr, value), nil
+	case "|=":
+		return fmt.Sprintf("%s=%s or starts-with(%s, %s)", attr, literal, attr, xpathLiteral(value+"-")), nil
+	case "^=":
+		return fmt.Sprintf("starts-with(%s, %s)", attr, literal), nil
+	case "$=":
+		return fmt.Sprintf("substring(%s, string-length(%s) - %d)=%s", attr, attr, utf8.RuneCountInString(value)-1, literal), nil
+	case "*=":
+		return fmt.Sprintf("contains(%s, %s)", attr, literal), nil
+	}
+	return attr + "=" + literal, nil
+}
+
+func (p *cssParser) parseValue() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' {
+		value := p.parseName()
+		if value == "" {
+			return "", p.errorf("expected attribute value")
+		}
+		return value, nil
+	}
+	end := strings.IndexByte(p.input[p.pos+1:], quote)
+	if end < 0 {
+		return "", p.errorf("unterminated string")
+	}
+	value := p.input[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return value, nil
+}
+
+func (p *cssParser) parsePseudo() (string, error) {
+	name := strings.ToLower(p.parseName())
+	switch name {
+	case "first-child":
+		return "not(preceding-sibling::*)", nil
+	case "last-child":
+		return "not(following-sibling::*)", nil
+	case "only-child":
+		return "not(preceding-sibling::*) and not(following-sibling::*)", nil
+	case "nth-child":
+		if !p.consume('(') {
+			return "", p.errorf("expected ( after :nth-child")
+		}
+		end := strings.IndexByte(p.input[p.pos:], ')')
+		if end < 0 {
+			return "", p.errorf("expected )")
+		}
+		a, b, ok := parseNth(p.input[p.pos : p.pos+end])
+		if !ok {
+			return "", p.errorf("invalid :nth-child argument")
+		}
+		p.pos += end + 1
+		return nthChildPredicate(a, b), nil
+	case "not":
+		if !p.consume('(') {
+			return "", p.errorf("expected ( after :not")
+		}
+		p.skipSpace()
+		step, e := p.parseCompound()
+		if e != nil {
+			return "", e
+		}
+		p.skipSpace()
+		if !p.consume(')') {
+			return "", p.errorf("expected )")
+		}
+		return "not(self::" + step + ")", nil
+	}
+	return "", p.errorf("unsupported pseudo-class :%s", name)
+}
+
+// parseNth parses the an+b argument of :nth-child.
+func parseNth(arg string) (int, int, bool) {
+	arg = strings.ToLower(strings.Replace(arg, " ", "", -1))
+	switch arg {
+	case "odd":
+		return 2, 1, true
+	case "even":
+		return 2, 0, true
+	}
+	i := strings.IndexByte(arg, 'n')
+	if i < 0 {
+		b, e := strconv.Atoi(arg)
+		return 0, b, e == nil
+	}
+
+	a := 1
+	switch arg[:i] {
+	case "", "+":
+	case "-":
+		a = -1
+	default:
+		var e error
+		if a, e = strconv.Atoi(arg[:i]); e != nil {
+			return 0, 0, false
+		}
+	}
+	b := 0
+	if rest := arg[i+1:]; rest != "" {
+		var e error
+		if b, e = strconv.Atoi(rest); e != nil {
+			return 0, 0, false
+		}
+	}
+	return a, b, true
+}
+
+// nthChildPredicate matches elements at positions a*n+b for some n >= 0.
+func nthChildPredicate(a, b int) string {
+	position := "count(preceding-sibling::*)+1"
+	if a == 0 {
+		return fmt.Sprintf("%s=%d", position, b)
+	}
+	return fmt.Sprintf("(%s-%d) mod %d=0 and (%s-%d) div %d>=0", position, b, a, position, b, a)
+}
+
+// containsToken matches attributes holding token in their space separated
+// list.
+func containsToken(attr string, token string) string {
+	return fmt.Sprintf(`contains(concat(" ", normalize-space(%s), " "), %s)`, attr, xpathLiteral(" "+token+" "))
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+const cssTestPage = `<html><body>
+<div id="main" class="content wide">
+  <h1>Title</h1>
+  <p class="lead">First</p>
+  <p lang="en-US">Second</p>
+  <ul><li>One</li><li class="x">Two</li><li>Three</li><li>Four</li></ul>
+  <a href="https://example.com/doc.pdf">PDF</a>
+</div>
+</body></html>`
+
+func TestCSSToXpath(t *testing.T) {
+	doc, e := parseHtml([]byte(cssTestPage))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+
+	for selector, expected := range map[string]string{
+		"h1":                      "Title",
+		"#main > p":               "First",
+		"div.content.wide p.lead": "First",
+		"p[lang|=en]":             "Second",
+		"h1 + p":                  "First",
+		"p.lead ~ p":              "Second",
+		"li:nth-child(2)":         "Two",
+		"li:nth-child(2n+3)":      "Three",
+		"li:last-child":           "Four",
+		"ul li:not(:first-child)": "Two",
+		"li:not(.x) + li":         "Two",
+		"a[href$='.pdf']":         "PDF",
+		`a[href^="https://"]`:     "PDF",
+		"blink, li.x":             "Two",
+		"ul > *:nth-child(even)":  "Two",
+		"[class~=wide] > h1":      "Title",
+		"  DIV   >   H1  ":        "Title",
+	} {
+		xpath, e := cssToXpath(selector)
+		if e != nil {
+			t.Errorf("Got error for '%s': %v", selector, e)
+			continue
+		}
+		if actual, e := searchXpath(doc, xpath, nil); e != nil || actual != expected {
+			t.Errorf("Got '%s' (%v) for '%s' as %s, wanted '%s'", actual, e, selector, xpath, expected)
+		}
+	}
+}
+
+func TestInvalidCSS(t *testing.T) {
+	for _, selector := range []string{"", "div >", "p[lang", "li:hover", "a[href=']", "#", "li:nth-child(x)"} {
+		if xpath, e := cssToXpath(selector); e == nil {
+			t.Errorf("Expected an error for '%s', got %s", selector, xpath)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moovweb/gokogiri/html"
+)
+
+// documentMemoryFactor estimates the memory libxml2 needs for a parsed
+// document relative to the size of its UTF-8 source.
+const documentMemoryFactor = 8
+
+var documents = newDocumentCache(256 << 20)
+
+type documentCacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int64
+	Bytes   int64
+}
+
+// parsedDoc is a parsed document shared between requests. It is freed once
+// it has been evicted from the cache and the last request released it.
+type parsedDoc struct {
+	key  string
+	url  string
+	doc  *html.HtmlDocument
+	size int64
+
+	// refs and evicted are guarded by the documentCache mutex.
+	refs    int
+	evicted bool
+
+	// searchMu serializes XPath evaluation because gokogiri evaluates all
+	// expressions on a document in one shared XPath context.
+	searchMu sync.Mutex
+}
+
+func (d *parsedDoc) search(xpath string, vars map[string]interface{}) (string, error) {
+	d.searchMu.Lock()
+	defer d.searchMu.Unlock()
+
+	return searchXpath(d.doc, xpath, vars)
+}
+
+// documentCache is an LRU of parsed documents keyed by URL and body hash,
+// bounded by the estimated memory of the documents it holds.
+type documentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+	byURL    map[string]*list.Element
+
+	// pending holds the parses in progress, so that concurrent requests
+	// for the same document share one parse.
+	pending map[string]*pendingParse
+
+	hits, misses, coalesced int64
+}
+
+type pendingParse struct {
+	done    chan struct{}
+	doc     *parsedDoc
+	err     error
+	waiters int
+}
+
+func newDocumentCache(maxBytes int64) *documentCache {
+	return &documentCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		byURL:    make(map[string]*list.Element),
+		pending:  make(map[string]*pendingParse),
+	}
+}
+
+func documentKey(url string, body []byte, contentType string) string {
+	h := sha256.New()
+	h.Write([]byte(contentType))
+	h.Write([]byte{0})
+	h.Write(body)
+	return url + "#" + hex.EncodeToString(h.Sum(nil))
+}
+
+// acquire returns the parsed document for body, parsing it on a cache miss.
+// Concurrent misses for the same document wait for a single parse. Every
+// successful acquire must be paired with a release.
+func (c *documentCache) acquire(url string, body []byte, contentType string) (*parsedDoc, error) {
+	key := documentKey(url, body, contentType)
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		d := el.Value.(*parsedDoc)
+		d.refs++
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return d, nil
+	}
+	if p, ok := c.pending[key]; ok {
+		p.waiters++
+		c.mu.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+		<-p.done
+		return p.doc, p.err
+	}
+	p := &pendingParse{done: make(chan struct{})}
+	c.pending[key] = p
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	p.doc, p.err = parseDocument(url, key, body, contentType)
+
+	c.mu.Lock()
+	delete(c.pending, key)
+	if p.err == nil {
+		p.doc.refs = 1 + p.waiters
+		c.insert(p.doc)
+	}
+	c.mu.Unlock()
+	close(p.done)
+
+	return p.doc, p.err
+}
+
+func parseDocument(url string, key string, body []byte, contentType string) (*parsedDoc, error) {
+	utf8bytes, e := convertToUtf8(body, contentType)
+	if e != nil {
+		return nil, e
+	}
+	doc, e := parseHtml(utf8bytes)
+	if e != nil {
+		return nil, e
+	}
+	return &parsedDoc{
+		key:  key,
+		url:  url,
+		doc:  doc,
+		size: int64(len(utf8bytes)) * documentMemoryFactor,
+	}, nil
+}
+
+// insert adds a freshly parsed document, evicting older versions of the
+// same page and then least recently used documents until it fits.
+func (c *documentCache) insert(d *parsedDoc) {
+	if d.size > c.maxBytes {
+		d.evicted = true
+		return
+	}
+	if el, ok := c.byURL[d.url]; ok {
+		c.evict(el)
+	}
+	el := c.ll.PushFront(d)
+	c.items[d.key] = el
+	c.byURL[d.url] = el
+	c.bytes += d.size
+	for c.bytes > c.maxBytes {
+		c.evict(c.ll.Back())
+	}
+}
+
+func (c *documentCache) release(d *parsedDoc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d.refs--
+	if d.refs == 0 && d.evicted {
+		d.doc.Free()
+	}
+}
+
+func (c *documentCache) evict(el *list.Element) {
+	d := c.ll.Remove(el).(*parsedDoc)
+	delete(c.items, d.key)
+	if c.byURL[d.url] == el {
+		delete(c.byURL, d.url)
+	}
+	c.bytes -= d.size
+	d.evicted = true
+	if d.refs == 0 {
+		d.doc.Free()
+	}
+}
+
+func (c *documentCache) coalescedParses() int64 {
+	return atomic.LoadInt64(&c.coalesced)
+}
+
+func (c *documentCache) stats() documentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return documentCacheStats{
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+		Entries: int64(c.ll.Len()),
+		Bytes:   c.bytes,
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDocumentCacheReusesParsedDocument(t *testing.T) {
+	cache := newDocumentCache(1 << 20)
+	body := []byte(testPage)
+
+	first, e := cache.acquire("http://example.com", body, "text/html")
+	if e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	cache.release(first)
+	second, _ := cache.acquire("http://example.com", body, "text/html")
+	cache.release(second)
+
+	if first != second {
+		t.Errorf("Expected the second acquire to reuse the parsed document")
+	}
+	if stats := cache.stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %+v", stats)
+	}
+}
+
+func TestDocumentCacheReplacesChangedPage(t *testing.T) {
+	cache := newDocumentCache(1 << 20)
+
+	d, _ := cache.acquire("http://example.com", []byte(testPage), "text/html")
+	cache.release(d)
+	d, _ = cache.acquire("http://example.com", []byte("<html><title>Changed</title></html>"), "text/html")
+	content, _ := d.search("//title", nil)
+	cache.release(d)
+
+	if content != "Changed" {
+		t.Errorf("Got '%v', wanted 'Changed'", content)
+	}
+	if entries := cache.stats().Entries; entries != 1 {
+		t.Errorf("Expected 1 cached document, got %d", entries)
+	}
+}
+
+func TestDocumentCacheConcurrentSearchAndEviction(t *testing.T) {
+	// Room for about two documents, so documents get evicted while in use.
+	cache := newDocumentCache(2 * documentMemoryFactor * int64(len(testPage)+16))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			url := fmt.Sprintf("http://example.com/%d", i%4)
+			d, e := cache.acquire(url, []byte(testPage), "text/html")
+			if e != nil {
+				t.Errorf("Did not expect an eror but got: %v", e)
+				return
+			}
+			defer cache.release(d)
+			if content, _ := d.search("//title", nil); content != "Cached Page" {
+				t.Errorf("Got '%v', wanted 'Cached Page'", content)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stats := cache.stats(); stats.Entries > 2 {
+		t.Errorf("Expected at most 2 cached documents, got %d", stats.Entries)
+	}
+}
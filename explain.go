@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/moovweb/gokogiri/xml"
+)
+
+const (
+	// maxExplainContext limits the nodes whose children or descendants are
+	// collected as candidates.
+	maxExplainContext = 50
+	// maxExplainCandidates limits the element and class names reported.
+	maxExplainCandidates = 10
+)
+
+// explanation tells how far an XPath that selects nothing got.
+type explanation struct {
+	// Steps are the prefixes of the location path up to the first one
+	// selecting nothing.
+	Steps []explainStep `json:"steps" xml:"step"`
+	// MatchedSteps is the number of leading steps that still select nodes.
+	MatchedSteps int `json:"matched_steps" xml:"matched_steps"`
+	// Elements and Classes are the most frequent names found where the
+	// first failing step looked, e.g. the children of the nodes the last
+	// matching step selected.
+	Elements []string `json:"elements,omitempty" xml:"element,omitempty"`
+	Classes  []string `json:"classes,omitempty" xml:"class,omitempty"`
+}
+
+type explainStep struct {
+	Step    string `json:"step" xml:"step"`
+	Xpath   string `json:"xpath" xml:"xpath"`
+	Matches int    `json:"matches" xml:"matches"`
+	// WithoutPredicates is the number of nodes a failing step selects
+	// without its predicates.
+	WithoutPredicates *int `json:"without_predicates,omitempty" xml:"without_predicates,omitempty"`
+}
+
+// explain evaluates ever longer prefixes of the location path of xpath
+// until one selects nothing and collects the names found there. It holds
+// the search lock throughout, as the prefixes and the candidate names are
+// searched in the document's shared XPath context.
+func (d *parsedDoc) explain(xpath string, vars map[string]interface{}) *explanation {
+	d.searchMu.Lock()
+	defer d.searchMu.Unlock()
+
+	doc := d.doc
+	ex := &explanation{}
+	steps := splitLocationPath(xpath)
+	var context []xml.Node
+	prefix := ""
+	for _, step := range steps {
+		prefix += step
+		nodes, e := searchUncached(doc, prefix, vars)
+		if e != nil {
+			break
+		}
+		s := explainStep{Step: step, Xpath: prefix, Matches: len(nodes)}
+		if len(nodes) == 0 {
+			if bare := withoutPredicates(step); bare != step {
+				if nodes, e := searchUncached(doc, strings.TrimSuffix(prefix, step)+bare, vars); e == nil {
+					count := len(nodes)
+					s.WithoutPredicates = &count
+				}
+			}
+			ex.Steps = append(ex.Steps, s)
+			break
+		}
+		ex.Steps = append(ex.Steps, s)
+		ex.MatchedSteps++
+		context = nodes
+	}
+
+	failing := ""
+	if ex.MatchedSteps < len(ex.Steps) {
+		failing = ex.Steps[ex.MatchedSteps].Step
+	}
+	below := "*"
+	if context == nil {
+		context, below = []xml.Node{doc.Root()}, "descendant-or-self::*"
+	} else if strings.HasPrefix(failing, "//") {
+		below = "descendant::*"
+	}
+	ex.Elements, ex.Classes = candidateNames(context, below)
+	return ex
+}
+
+// splitLocationPath splits a location path into its steps, each with its
+// leading / or //. Unions are not split, so they are explained as a whole.
+func splitLocationPath(xpath string) []string {
+	var steps []string
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(xpath); i++ {
+		switch c := xpath[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case depth == 0 && c == '|':
+			return []string{xpath}
+		case depth == 0 && c == '/' && i > start && xpath[i-1] != '/':
+			steps = append(steps, xpath[start:i])
+			start = i
+		}
+	}
+	return append(steps, xpath[start:])
+}
+
+// withoutPredicates strips the predicates off a step.
+func withoutPredicates(step string) string {
+	if i := strings.IndexByte(step, '['); i > 0 {
+		return step[:i]
+	}
+	return step
+}
+
+// candidateNames returns the most frequent element and class names of the
+// nodes selected by below from the context nodes.
+func candidateNames(context []xml.Node, below string) ([]string, []string) {
+	elements := make(map[string]int)
+	classes := make(map[string]int)
+	for i, node := range context {
+		if i == maxExplainContext {
+			break
+		}
+		nodes, e := node.Search(below)
+		if e != nil {
+			continue
+		}
+		for _, n := range nodes {
+			elements[elementName(n)]++
+			for _, class := range strings.Fields(n.Attr("class")) {
+				classes[class]++
+			}
+		}
+	}
+	return mostFrequent(elements), mostFrequent(classes)
+}
+
+func mostFrequent(counts map[string]int) []string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > maxExplainCandidates {
+		names = names[:maxExplainCandidates]
+	}
+	return names
+}
+
+// printExplanation writes an explanation for the command line.
+func printExplanation(w io.Writer, ex *explanation) {
+	for _, s := range ex.Steps {
+		fmt.Fprintf(w, "%6d  %s", s.Matches, s.Xpath)
+		if s.WithoutPredicates != nil {
+			fmt.Fprintf(w, "  (%d without predicates)", *s.WithoutPredicates)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(ex.Elements) > 0 {
+		fmt.Fprintf(w, "Elements there: %s\n", strings.Join(ex.Elements, ", "))
+	}
+	if len(ex.Classes) > 0 {
+		fmt.Fprintf(w, "Classes there: %s\n", strings.Join(ex.Classes, ", "))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func explainFor(t *testing.T, xpath string) *explanation {
+	doc, e := parseHtml([]byte(cssTestPage))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+	return (&parsedDoc{doc: doc}).explain(xpath, nil)
+}
+
+func TestSplitLocationPath(t *testing.T) {
+	for xpath, expected := range map[string][]string{
+		"//div[@id='a/b']/ul//li[2]": {"//div[@id='a/b']", "/ul", "//li[2]"},
+		"/html/body":                 {"/html", "/body"},
+		"body/div[p/a]":              {"body", "/div[p/a]"},
+		"//a | //b":                  {"//a | //b"},
+		"count(//a/b)":               {"count(//a/b)"},
+	} {
+		if actual := splitLocationPath(xpath); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Got %q for %s, wanted %q", actual, xpath, expected)
+		}
+	}
+}
+
+func TestExplainFailingPredicate(t *testing.T) {
+	ex := explainFor(t, `//div[@id="main"]/ul/li[@class="y"]/a`)
+
+	if ex.MatchedSteps != 2 || len(ex.Steps) != 3 {
+		t.Fatalf("Got %+v", ex)
+	}
+	if s := ex.Steps[0]; s.Step != `//div[@id="main"]` || s.Matches != 1 {
+		t.Errorf("Got %+v", s)
+	}
+	s := ex.Steps[2]
+	if s.Xpath != `//div[@id="main"]/ul/li[@class="y"]` || s.Matches != 0 || s.WithoutPredicates == nil || *s.WithoutPredicates != 4 {
+		t.Errorf("Got %+v", s)
+	}
+	if !reflect.DeepEqual(ex.Elements, []string{"li"}) || !reflect.DeepEqual(ex.Classes, []string{"x"}) {
+		t.Errorf("Got elements %v and classes %v", ex.Elements, ex.Classes)
+	}
+}
+
+func TestExplainLeavesExpressionCacheAlone(t *testing.T) {
+	before := expressions.stats()
+	explainFor(t, `//div[@id="main"]/ul/li[@class="y"]/a`)
+	if after := expressions.stats(); after != before {
+		t.Errorf("Expected the prefixes not to go through the cache, got %+v before and %+v after", before, after)
+	}
+}
+
+func TestExplainFailingFirstStep(t *testing.T) {
+	ex := explainFor(t, "//section/p")
+
+	if ex.MatchedSteps != 0 || len(ex.Steps) != 1 || ex.Steps[0].WithoutPredicates != nil {
+		t.Fatalf("Got %+v", ex)
+	}
+	// The whole document is searched, most frequent names first.
+	if len(ex.Elements) == 0 || ex.Elements[0] != "li" || !reflect.DeepEqual(ex.Classes, []string{"content", "lead", "wide", "x"}) {
+		t.Errorf("Got elements %v and classes %v", ex.Elements, ex.Classes)
+	}
+}
+
+func TestGetExplain(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, cssTestPage)
+	}))
+	defer server.Close()
+
+	recorder := httptest.NewRecorder()
+	requestHandler(recorder, httptest.NewRequest("GET", "/get?explain=true&xpath=//ul/li/b&url="+server.URL, nil))
+	var res map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &res)
+	ex, ok := res["explanation"].(map[string]interface{})
+	if res["error"] != "Xpath not found" || !ok || ex["matched_steps"] != 2.0 {
+		t.Errorf("Got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	requestHandler(recorder, httptest.NewRequest("GET", "/get?explain=true&xpath=//ul/li&url="+server.URL, nil))
+	if strings.Contains(recorder.Body.String(), "explanation") {
+		t.Errorf("Got explanation for a matching XPath: %s", recorder.Body.String())
+	}
+}
+
+func TestGetCommandExplain(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, _, stderr := runTestCommand("get", "-explain", server.URL, "//head/meta")
+	if code != exitFailure || !strings.Contains(stderr, "     1  //head\n     0  //head/meta\n") || !strings.Contains(stderr, "Elements there: title") {
+		t.Errorf("Got exit code %d and %s", code, stderr)
+	}
+}
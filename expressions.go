@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moovweb/gokogiri/xpath"
+)
+
+var expressions = newExpressionCache(1000)
+
+type expressionCacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int64
+}
+
+// compiledXpath is a compiled XPath shared between requests. libxml2 does
+// not modify compiled expressions while evaluating them, so one may be
+// evaluated on several documents at once. It is freed once it has been
+// evicted from the cache and the last request released it.
+type compiledXpath struct {
+	xpath string
+	expr  *xpath.Expression
+
+	// refs and evicted are guarded by the expressionCache mutex.
+	refs    int
+	evicted bool
+}
+
+// expressionCache is an LRU of compiled XPaths keyed by the expression.
+type expressionCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+
+	hits, misses int64
+}
+
+func newExpressionCache(maxEntries int) *expressionCache {
+	return &expressionCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// acquire returns the compiled path, compiling it on a cache miss. Invalid
+// XPaths fail with the error code invalid_xpath. Every successful acquire
+// must be paired with a release.
+func (c *expressionCache) acquire(path string) (*compiledXpath, error) {
+	c.mu.Lock()
+	if el, ok := c.items[path]; ok {
+		c.ll.MoveToFront(el)
+		x := el.Value.(*compiledXpath)
+		x.refs++
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return x, nil
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	x, e := compileXpath(path)
+	if e != nil {
+		return nil, e
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[path]; ok {
+		// Compiled concurrently by another request.
+		x.expr.Free()
+		x = el.Value.(*compiledXpath)
+		x.refs++
+		return x, nil
+	}
+	x.refs = 1
+	if c.maxEntries <= 0 {
+		x.evicted = true
+		return x, nil
+	}
+	c.items[path] = c.ll.PushFront(x)
+	for c.ll.Len() > c.maxEntries {
+		c.evict(c.ll.Back())
+	}
+	return x, nil
+}
+
+func (c *expressionCache) release(x *compiledXpath) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	x.refs--
+	if x.refs == 0 && x.evicted {
+		x.expr.Free()
+	}
+}
+
+func (c *expressionCache) evict(el *list.Element) {
+	x := c.ll.Remove(el).(*compiledXpath)
+	delete(c.items, x.xpath)
+	x.evicted = true
+	if x.refs == 0 {
+		x.expr.Free()
+	}
+}
+
+func (c *expressionCache) stats() expressionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return expressionCacheStats{
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+		Entries: int64(c.ll.Len()),
+	}
+}
+
+// validateXpath checks the syntax of path, compiling it into the cache for
+// the extraction that follows.
+func validateXpath(path string) error {
+	x, e := expressions.acquire(path)
+	if e != nil {
+		return e
+	}
+	expressions.release(x)
+	return nil
+}
+
+func compileXpath(path string) (*compiledXpath, error) {
+	if e := xpath.Check(path); e != nil {
+		return nil, invalidXpath(path, e.Error())
+	}
+	expr := xpath.Compile(path)
+	if expr == nil {
+		return nil, invalidXpath(path, "Could not compile it")
+	}
+	return &compiledXpath{xpath: path, expr: expr}, nil
+}
+
+// invalidXpath reports a syntax error of path. libxml2 marks the position
+// of the error with a caret below the path, which is kept in the message.
+func invalidXpath(path string, message string) error {
+	lines := strings.Split(message, "\n")
+	last := lines[len(lines)-1]
+	if len(lines) < 3 || !strings.HasSuffix(last, "^") {
+		return &queryError{Code: "invalid_xpath", Message: fmt.Sprintf("Invalid XPath %s: %s", path, lines[0])}
+	}
+	return &queryError{Code: "invalid_xpath", Message: fmt.Sprintf("Invalid XPath at position %d: %s", len(last), message)}
+}
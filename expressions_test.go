@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInvalidXpathReportsPosition(t *testing.T) {
+	_, e := compileXpath("//a[@x='1']]")
+	if errorCode(e) != "invalid_xpath" || !strings.HasPrefix(e.Error(), "Invalid XPath at position 12: Invalid expression\n//a[@x='1']]\n") {
+		t.Errorf("Got %v", e)
+	}
+}
+
+func TestExpressionCacheReusesCompiledXpaths(t *testing.T) {
+	c := newExpressionCache(2)
+	x, e := c.acquire("//a")
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.release(x)
+	y, _ := c.acquire("//a")
+	c.release(y)
+	if x != y {
+		t.Error("Expected the compiled XPath to be reused")
+	}
+	if s := c.stats(); s.Hits != 1 || s.Misses != 1 || s.Entries != 1 {
+		t.Errorf("Got %+v", s)
+	}
+}
+
+func TestExpressionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newExpressionCache(2)
+	held, _ := c.acquire("//a")
+	for _, path := range []string{"//b", "//c"} {
+		x, _ := c.acquire(path)
+		c.release(x)
+	}
+	if _, ok := c.items["//a"]; ok || c.ll.Len() != 2 {
+		t.Errorf("Expected //a to be evicted, got %d entries", c.ll.Len())
+	}
+	// Evicted expressions stay usable until released.
+	if !held.evicted || held.expr.Ptr == nil {
+		t.Fatal("Expected the held expression to be evicted but not freed")
+	}
+	c.release(held)
+	if held.expr.Ptr != nil {
+		t.Error("Expected the expression to be freed on release")
+	}
+}
+
+func TestExpressionCacheDisabled(t *testing.T) {
+	c := newExpressionCache(0)
+	x, _ := c.acquire("//a")
+	c.release(x)
+	if c.ll.Len() != 0 || x.expr.Ptr != nil {
+		t.Errorf("Expected nothing to be cached")
+	}
+}
+
+func TestGetRejectsInvalidXpathBeforeFetching(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(testPage))
+	}))
+	defer server.Close()
+
+	recorder := httptest.NewRecorder()
+	requestHandler(recorder, httptest.NewRequest("GET", "/get?xpath=//title[&url="+server.URL, nil))
+	if recorder.Code != 400 || !strings.Contains(recorder.Body.String(), `"error_code":"invalid_xpath"`) {
+		t.Errorf("Got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&fetches) != 0 {
+		t.Error("Expected no fetch for an invalid XPath")
+	}
+}
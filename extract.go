@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+)
+
+// maxDocumentSize limits the size of documents posted to /extract.
+var maxDocumentSize int64 = 5 << 20
+
+// extractHandler evaluates an XPath on the document sent in the request
+// body, raw or as the document part of a multipart form, without fetching
+// anything.
+func extractHandler(writer http.ResponseWriter, req *http.Request) {
+	startRequest(req)
+	format, formatErr := negotiateFormat(req)
+
+	q, body, code, e := parseExtractRequest(writer, req)
+	res := result{
+		Query: q,
+	}
+	if formatErr != nil {
+		code = 400
+		res.Error = formatErr.Error()
+	} else if e != nil {
+		res.Error = e.Error()
+		res.ErrorCode = errorCode(e)
+	} else {
+		code = 200
+		atomic.AddInt64(&status.BytesProcessed, int64(len(body)))
+		content, info, e := extractDocument(body, q)
+		res.setExtraction(content, info, e)
+		if isInvalidQuery(e) {
+			code = 400
+		}
+	}
+
+	countResult(res.Error != nil)
+	writeResult(writer, format, code, res)
+}
+
+// parseExtractRequest reads the document and the query from a POST
+// /extract request. The xpath, content_type, matches, explain and variable
+// parameters come from the URL or the form; without content_type the
+// document's Content-Type is used.
+// On failure it returns the HTTP status code to answer with.
+func parseExtractRequest(writer http.ResponseWriter, req *http.Request) (query, []byte, int, error) {
+	q := query{Options: &queryOptions{}}
+	if req.Method != "POST" {
+		return q, nil, 405, fmt.Errorf("Only POST is supported.")
+	}
+
+	values := req.URL.Query()
+	var body []byte
+	contentType := req.Header.Get("Content-Type")
+	var e error
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "multipart/form-data" {
+		req.Body = http.MaxBytesReader(writer, req.Body, maxDocumentSize+maxQueryBodySize)
+		body, contentType, e = readMultipartDocument(req, values)
+	} else {
+		body, e = readDocument(req.Body)
+	}
+	if e != nil {
+		if errorCode(e) == "document_too_large" {
+			return q, nil, 413, e
+		}
+		return q, nil, 400, e
+	}
+
+	q.Xpath = values.Get("xpath")
+	options, e := parseQueryOptions(values)
+	if e != nil {
+		return q, nil, 400, e
+	}
+	if options != nil {
+		q.Options = options
+	}
+	if q.Options.ContentType == "" {
+		q.Options.ContentType = contentType
+	}
+	if q.Vars, e = parseVariables(values); e != nil {
+		return q, nil, 400, e
+	}
+	if len(q.Xpath) == 0 {
+		return q, nil, 400, fmt.Errorf("Need xpath parameter.")
+	}
+	if len(body) == 0 {
+		return q, nil, 400, fmt.Errorf("Need a document in the request body.")
+	}
+	return q, body, 0, nil
+}
+
+func readDocument(r io.Reader) ([]byte, error) {
+	body, e := ioutil.ReadAll(io.LimitReader(r, maxDocumentSize+1))
+	if e != nil {
+		return nil, e
+	}
+	if int64(len(body)) > maxDocumentSize {
+		return nil, &queryError{Code: "document_too_large", Message: fmt.Sprintf("Document exceeds %d bytes.", maxDocumentSize)}
+	}
+	return body, nil
+}
+
+// readMultipartDocument returns the document part and its content type,
+// adding the other parts to values.
+func readMultipartDocument(req *http.Request, values neturl.Values) ([]byte, string, error) {
+	reader, e := req.MultipartReader()
+	if e != nil {
+		return nil, "", fmt.Errorf("Invalid multipart body: %v", e)
+	}
+	var body []byte
+	var contentType string
+	for {
+		part, e := reader.NextPart()
+		if e == io.EOF {
+			return body, contentType, nil
+		}
+		if e != nil {
+			return nil, "", fmt.Errorf("Invalid multipart body: %v", e)
+		}
+
+		if part.FormName() == "document" {
+			if body, e = readDocument(part); e != nil {
+				return nil, "", e
+			}
+			contentType = part.Header.Get("Content-Type")
+			continue
+		}
+		value, e := ioutil.ReadAll(io.LimitReader(part, maxQueryBodySize))
+		if e != nil {
+			return nil, "", fmt.Errorf("Invalid multipart body: %v", e)
+		}
+		values.Set(part.FormName(), string(value))
+	}
+}
+
+// extractDocument runs a document through the same charset conversion,
+// parsing and evaluation as fetched pages.
+func extractDocument(body []byte, q query) (string, fetchInfo, error) {
+	var info fetchInfo
+	if e := validateXpath(q.Xpath); e != nil {
+		return "", info, e
+	}
+	if e := checkVariables(q.Xpath, q.Vars); e != nil {
+		return "", info, e
+	}
+	d, e := parseDocument("", "", body, q.Options.ContentType)
+	if e != nil {
+		return "", info, e
+	}
+	defer d.doc.Free()
+
+	content, e := evaluateQuery(d, q, &info)
+	return content, info, e
+}
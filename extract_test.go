@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postExtract(url string, contentType string, body []byte) (int, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	extractHandler(recorder, req)
+
+	var res map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &res)
+	return recorder.Code, res
+}
+
+func TestExtractRawDocument(t *testing.T) {
+	code, res := postExtract("/extract?xpath=//p", "text/html; charset=iso-8859-1", []byte("<html><body><p>M\xfcnchen</p></body></html>"))
+	if code != 200 || res["result"] != "München" {
+		t.Errorf("Got %d and %v", code, res)
+	}
+}
+
+func TestExtractContentTypeParameterOverridesHeader(t *testing.T) {
+	code, res := postExtract("/extract?xpath=//p&content_type=text/html;+charset=iso-8859-1", "application/octet-stream", []byte("<p>M\xfcnchen</p>"))
+	if code != 200 || res["result"] != "München" {
+		t.Errorf("Got %d and %v", code, res)
+	}
+}
+
+func TestExtractMultipartDocument(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("xpath", "//title")
+	document, _ := form.CreateFormFile("document", "page.html")
+	document.Write([]byte("<html><head><title>Posted Page</title></head></html>"))
+	form.Close()
+
+	code, res := postExtract("/extract", form.FormDataContentType(), body.Bytes())
+	if code != 200 || res["result"] != "Posted Page" {
+		t.Errorf("Got %d and %v", code, res)
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	defer func(saved int64) { maxDocumentSize = saved }(maxDocumentSize)
+	maxDocumentSize = 16
+
+	if code, res := postExtract("/extract", "text/html", []byte("<p>x</p>")); code != 400 || res["error"] != "Need xpath parameter." {
+		t.Errorf("Got %d and %v", code, res)
+	}
+	if code, res := postExtract("/extract?xpath=//p", "text/html", nil); code != 400 {
+		t.Errorf("Got %d and %v", code, res)
+	}
+	if code, res := postExtract("/extract?xpath=//p", "text/html", []byte(strings.Repeat("x", 17))); code != 413 || res["error_code"] != "document_too_large" {
+		t.Errorf("Got %d and %v", code, res)
+	}
+
+	req, _ := http.NewRequest("GET", "/extract?xpath=//p", nil)
+	recorder := httptest.NewRecorder()
+	extractHandler(recorder, req)
+	if recorder.Code != 405 {
+		t.Errorf("Got %d, wanted 405", recorder.Code)
+	}
+}
+
+func TestExtractMatchesAndExplain(t *testing.T) {
+	page := []byte("<html><body><ul><li>One</li><li>Two</li></ul></body></html>")
+
+	code, res := postExtract("/extract?xpath=//li&matches=true", "text/html", page)
+	matches, _ := res["matches"].([]interface{})
+	if code != 200 || res["match_count"] != 2.0 || len(matches) != 2 {
+		t.Errorf("Got %d and %v", code, res)
+	}
+
+	code, res = postExtract("/extract?xpath=//ul/li[@class='x']&explain=true", "text/html", page)
+	explanation, _ := res["explanation"].(map[string]interface{})
+	if code != 200 || explanation == nil || explanation["matched_steps"] != 1.0 {
+		t.Errorf("Got %d and %v", code, res)
+	}
+
+	if code, res := postExtract("/extract?xpath=//li&matches=maybe", "text/html", page); code != 400 {
+		t.Errorf("Got %d and %v", code, res)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// resultFormat encodes results for one media type.
+type resultFormat struct {
+	name        string
+	mediaType   string
+	contentType string
+	encode      func(io.Writer, response) error
+}
+
+// response is what the formats encode, a result or the suggestions for a
+// text.
+type response interface {
+	// text is the plain text form of the response.
+	text() string
+	// csv returns the CSV header and records of the response.
+	csv() ([]string, [][]string)
+}
+
+// resultFormats lists the supported formats, the first being the default.
+var resultFormats = []resultFormat{
+	{"json", "application/json", "application/json; charset=utf-8", encodeJSON},
+	{"text", "text/plain", "text/plain; charset=utf-8", encodeText},
+	{"csv", "text/csv", "text/csv; charset=utf-8", encodeCSV},
+	{"xml", "application/xml", "application/xml; charset=utf-8", encodeXML},
+	{"ndjson", "application/x-ndjson", "application/x-ndjson; charset=utf-8", encodeNDJSON},
+}
+
+// negotiateFormat picks the format of the response: JSONP if there is a
+// callback parameter, else the one named by the format parameter or else
+// by the Accept header, falling back to JSON. An invalid callback or an
+// unknown format parameter is an error.
+func negotiateFormat(req *http.Request) (resultFormat, error) {
+	if callback := req.URL.Query().Get("callback"); callback != "" {
+		return jsonpFormat(callback)
+	}
+	if name := req.URL.Query().Get("format"); name != "" {
+		names := make([]string, len(resultFormats))
+		for i, f := range resultFormats {
+			if f.name == name {
+				return f, nil
+			}
+			names[i] = f.name
+		}
+		return resultFormats[0], fmt.Errorf("Unknown format %s, use one of %s.", name, strings.Join(names, ", "))
+	}
+
+	for _, mediaType := range acceptedMediaTypes(req.Header.Get("Accept")) {
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return resultFormats[0], nil
+		}
+		for _, f := range resultFormats {
+			if f.mediaType == mediaType || mediaType == "text/xml" && f.name == "xml" || mediaType == "text/*" && f.name == "text" {
+				return f, nil
+			}
+		}
+	}
+	return resultFormats[0], nil
+}
+
+// acceptedMediaTypes returns the media types of an Accept header ordered by
+// descending quality, leaving out those with quality 0.
+func acceptedMediaTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		quality   float64
+	}
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, e := mime.ParseMediaType(strings.TrimSpace(part))
+		if e != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, e = strconv.ParseFloat(q, 64); e != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			types = append(types, accepted{mediaType, quality})
+		}
+	}
+	sort.SliceStable(types, func(i, j int) bool { return types[i].quality > types[j].quality })
+
+	mediaTypes := make([]string, len(types))
+	for i, t := range types {
+		mediaTypes[i] = t.mediaType
+	}
+	return mediaTypes
+}
+
+func writeResult(writer http.ResponseWriter, format resultFormat, code int, res response) {
+	writer.Header().Set("Content-Type", format.contentType)
+	if format.name == "jsonp" {
+		// Browsers do not run scripts answered with an error status, so
+		// JSONP callers only learn about errors from the result.
+		writer.Header().Set("X-Content-Type-Options", "nosniff")
+		code = http.StatusOK
+	}
+	writer.WriteHeader(code)
+	if e := format.encode(writer, res); e != nil {
+		logger.Printf("ERROR: Could not write %s result: %v", format.name, e)
+	}
+}
+
+func encodeJSON(w io.Writer, res response) error {
+	bytes, e := json.Marshal(res)
+	if e != nil {
+		return e
+	}
+	_, e = w.Write(bytes)
+	return e
+}
+
+func encodeNDJSON(w io.Writer, res response) error {
+	return json.NewEncoder(w).Encode(res)
+}
+
+func encodeText(w io.Writer, res response) error {
+	_, e := io.WriteString(w, res.text())
+	return e
+}
+
+// text is just the extracted text, or the error message.
+func (res result) text() string {
+	if res.Error != nil {
+		return fmt.Sprint(res.Error)
+	}
+	return res.Result
+}
+
+// csvHeader are the columns of CSV results, one record per result or, when
+// the matches were asked for, per match.
+var csvHeader = []string{"url", "xpath", "result", "error", "error_code"}
+
+func encodeCSV(w io.Writer, res response) error {
+	writer := csv.NewWriter(w)
+	header, records := res.csv()
+	writer.Write(header)
+	for _, record := range records {
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (res result) csv() ([]string, [][]string) {
+	if len(res.Matches) == 0 {
+		return csvHeader, [][]string{csvRecord(res)}
+	}
+	records := make([][]string, len(res.Matches))
+	for i, m := range res.Matches {
+		res.Result = m.Text
+		records[i] = csvRecord(res)
+	}
+	return csvHeader, records
+}
+
+func csvRecord(res result) []string {
+	var q query
+	if rq, ok := res.Query.(query); ok {
+		q = rq
+	}
+	var message string
+	if res.Error != nil {
+		message = fmt.Sprint(res.Error)
+	}
+	return []string{q.URL, q.Xpath, res.Result, message, res.ErrorCode}
+}
+
+func encodeXML(w io.Writer, res response) error {
+	if _, e := io.WriteString(w, xml.Header); e != nil {
+		return e
+	}
+	return xml.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, c := range []struct {
+		target, accept, expected string
+	}{
+		{"/get", "", "json"},
+		{"/get", "*/*", "json"},
+		{"/get", "text/plain", "text"},
+		{"/get", "text/html, text/csv;q=0.9, */*;q=0.1", "csv"},
+		{"/get", "application/json;q=0.5, application/xml", "xml"},
+		{"/get", "text/xml", "xml"},
+		{"/get", "text/html", "json"},
+		{"/get", "text/plain;q=0, application/x-ndjson", "ndjson"},
+		{"/get?format=text", "application/json", "text"},
+	} {
+		req, _ := http.NewRequest("GET", c.target, nil)
+		req.Header.Set("Accept", c.accept)
+		if format, _ := negotiateFormat(req); format.name != c.expected {
+			t.Errorf("Got %v for %v with Accept '%v', wanted %v", format.name, c.target, c.accept, c.expected)
+		}
+	}
+}
+
+func TestUnknownFormatIsRejected(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/get?format=unknown&url=http://example.com&xpath=//title", nil)
+	req.Header.Set("Accept", "text/csv")
+	if _, e := negotiateFormat(req); e == nil || !strings.Contains(e.Error(), "json, text, csv, xml, ndjson") {
+		t.Errorf("Got %v, wanted an error listing the formats", e)
+	}
+
+	recorder := httptest.NewRecorder()
+	requestHandler(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, wanted 400", recorder.Code)
+	}
+}
+
+func TestEncodeFormats(t *testing.T) {
+	res := result{
+		Query:  query{URL: "http://example.com", Xpath: "//title"},
+		Result: `Example "Domain", Inc.`,
+	}
+	for name, expected := range map[string]string{
+		"json":   `{"query":{"url":"http://example.com","xpath":"//title"},"result":"Example \"Domain\", Inc.","error":null}`,
+		"ndjson": `{"query":{"url":"http://example.com","xpath":"//title"},"result":"Example \"Domain\", Inc.","error":null}` + "\n",
+		"text":   `Example "Domain", Inc.`,
+		"csv":    "url,xpath,result,error,error_code\nhttp://example.com,//title,\"Example \"\"Domain\"\", Inc.\",,\n",
+		"xml":    `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<getxpath><query><url>http://example.com</url><xpath>//title</xpath></query><result>Example &#34;Domain&#34;, Inc.</result></getxpath>`,
+	} {
+		req, _ := http.NewRequest("GET", "/get?format="+name, nil)
+		recorder := httptest.NewRecorder()
+		format, _ := negotiateFormat(req)
+		writeResult(recorder, format, 200, res)
+		if actual := recorder.Body.String(); actual != expected {
+			t.Errorf("Got %v result\n%v\nwanted\n%v", name, actual, expected)
+		}
+	}
+}
+
+func TestEncodeCSVMatches(t *testing.T) {
+	res := result{
+		Query:      query{URL: "http://example.com", Xpath: "//li"},
+		Result:     "One",
+		MatchCount: 2,
+		Matches:    []match{{Text: "One"}, {Text: "Two"}},
+	}
+	recorder := httptest.NewRecorder()
+	writeResult(recorder, resultFormats[2], 200, res)
+	expected := "url,xpath,result,error,error_code\nhttp://example.com,//li,One,,\nhttp://example.com,//li,Two,,\n"
+	if actual := recorder.Body.String(); actual != expected {
+		t.Errorf("Got\n%v\nwanted\n%v", actual, expected)
+	}
+}
+
+func TestEncodeTextError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeResult(recorder, resultFormats[1], 400, result{Error: "Need both url and xpath query parameter."})
+	if recorder.Code != 400 || recorder.Body.String() != "Need both url and xpath query parameter." {
+		t.Errorf("Got %d '%v'", recorder.Code, recorder.Body.String())
+	}
+}
@@ -4,85 +4,222 @@ import _ "expvar"
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/moovweb/gokogiri"
+	"github.com/moovweb/gokogiri/html"
 	"golang.org/x/net/html/charset"
 )
 
 var logger = log.New(os.Stdout, "getxpath: ", log.LstdFlags|log.Lmicroseconds)
 
-func readBodyFromURL(url string) ([]byte, string, error) {
-	resp, e := http.Get(url)
-	for retries := 1; e != nil && retries <= 3; retries++ {
+const userAgent = "getxpath (+https://github.com/mat/getxpath)"
+
+type upstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// QueueWait is the time the fetch waited for per-host rate limits.
+	QueueWait time.Duration
+	// Redirects are the URLs the fetch was redirected to, in order.
+	Redirects []string
+}
+
+func readBodyFromURL(ctx context.Context, url string, header http.Header) (*upstreamResponse, error) {
+	var queueWait int64
+	ctx = withQueueWait(ctx, &queueWait)
+
+	var redirects []string
+	resp, e := get(withRedirects(ctx, &redirects), url, header)
+	for retries := 1; e != nil && errorCode(e) == "" && retries <= fetchRetries; retries++ {
+		backoff := time.Duration(retries) * time.Second
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			break
+		}
 		logger.Printf("Retrying to fetch %s (%d)\n", url, retries)
-		time.Sleep(time.Duration(retries) * time.Second)
-		resp, e = http.Get(url)
+		if e := sleep(ctx, backoff); e != nil {
+			break
+		}
+		redirects = nil
+		resp, e = get(withRedirects(ctx, &redirects), url, header)
 	}
 	if e != nil {
-		logger.Printf("Fetching %s failed too many times.", url)
-		return nil, "", e
+		if errorCode(e) == "" {
+			logger.Printf("Fetching %s failed too many times.", url)
+		}
+		return nil, e
 	}
+	defer resp.Body.Close()
 
 	bytes, e := ioutil.ReadAll(resp.Body)
 	if e != nil {
-		return nil, "", e
+		return nil, e
 	}
-	defer resp.Body.Close()
 
-	contentType := resp.Header.Get("Content-Type")
+	return &upstreamResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       bytes,
+		QueueWait:  time.Duration(atomic.LoadInt64(&queueWait)),
+		Redirects:  redirects,
+	}, nil
+}
 
-	return bytes, contentType, nil
+// sleep waits for d unless ctx ends before.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, e := http.NewRequest("GET", url, nil)
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, e := httpClient.Do(req.WithContext(ctx))
+	if ue, ok := e.(*neturl.Error); ok {
+		if qe, ok := ue.Err.(*queryError); ok {
+			return nil, qe
+		}
+	}
+	return resp, e
 }
 
 func timeFromUnixTimeStampString(str string) time.Time {
 	n, _ := strconv.Atoi(str)
-	loc, _ := time.LoadLocation("CET")
+	loc, _ := time.LoadLocation(timezone)
 
 	return time.Unix(int64(n), 0).In(loc)
 }
 
 func extractXpathFromURL(url string, xpath string) (string, error) {
-	bodyBytes, contentType, e := readBodyFromURL(url)
+	content, _, e := extractQuery(context.Background(), query{URL: url, Xpath: xpath})
+	return content, e
+}
+
+func extractQuery(ctx context.Context, q query) (string, fetchInfo, error) {
+	if e := validateXpath(q.Xpath); e != nil {
+		return "", fetchInfo{}, e
+	}
+	if e := checkVariables(q.Xpath, q.Vars); e != nil {
+		return "", fetchInfo{}, e
+	}
+	resp, info, e := fetchDocument(ctx, q)
 	if e != nil {
-		return "", e
+		return "", info, e
 	}
-	status.BytesProcessed += int64(len(bodyBytes))
+	atomic.AddInt64(&status.BytesProcessed, int64(len(resp.Body)))
 
-	utf8bytes, e := convertToUtf8(bodyBytes, contentType)
+	contentType := resp.Header.Get("Content-Type")
+	if q.Options != nil && q.Options.ContentType != "" {
+		contentType = q.Options.ContentType
+	}
+	d, e := documents.acquire(q.URL, resp.Body, contentType)
 	if e != nil {
-		return "", e
+		return "", info, e
+	}
+	defer documents.release(d)
+
+	content, e := evaluateQuery(d, q, &info)
+	return content, info, e
+}
+
+// evaluateQuery evaluates the XPath of q on d, describing its matches and
+// explaining why it selects nothing if the options of q ask for it.
+func evaluateQuery(d *parsedDoc, q query, info *fetchInfo) (string, error) {
+	var content string
+	var e error
+	if q.Options != nil && q.Options.Matches {
+		content, info.Matches, e = d.searchMatches(q.Xpath, q.Vars)
+	} else {
+		content, e = d.search(q.Xpath, q.Vars)
+	}
+	if e == errXpathNotFound && q.Options != nil && q.Options.Explain {
+		info.Explanation = d.explain(q.Xpath, q.Vars)
 	}
+	return content, e
+}
 
+// fetchDocument reads the document of a query from the web, a local file or
+// stdin. Redirects have to pass the fetch checks of ctx.
+func fetchDocument(ctx context.Context, q query) (*upstreamResponse, fetchInfo, error) {
+	var info fetchInfo
+	if isLocalURL(q.URL) {
+		resp, e := readLocal(q.URL)
+		return resp, info, e
+	}
+	if enforceRobots || q.Options != nil && q.Options.Robots {
+		if e := checkRobots(ctx, q.URL); e != nil {
+			return nil, info, e
+		}
+		ctx = withRobotsCheck(ctx)
+	}
+	resp, cacheStatus, e := readBodyCached(ctx, q.URL, q.Options)
+	info.Cache = cacheStatus
+	if e != nil {
+		return nil, info, e
+	}
+	if e := checkRedirects(ctx, resp.Redirects); e != nil {
+		return nil, info, e
+	}
+	if cacheStatus != cacheHit {
+		info.QueueWait = resp.QueueWait
+	}
+	return resp, info, nil
+}
+
+func parseHtml(utf8bytes []byte) (*html.HtmlDocument, error) {
 	doc, e := gokogiri.ParseHtml(utf8bytes)
 	if e != nil {
-		return "", e
+		return nil, e
 	}
 	if doc == nil {
-		return "", fmt.Errorf("Could not ParseHtml")
+		return nil, fmt.Errorf("Could not ParseHtml")
 	}
-	defer doc.Free()
-
-	root := doc.Root()
-	if root == nil {
-		return "", fmt.Errorf("Could not ParseHtml: Doc has no root")
+	if doc.Root() == nil {
+		doc.Free()
+		return nil, fmt.Errorf("Could not ParseHtml: Doc has no root")
 	}
+	return doc, nil
+}
+
+// errXpathNotFound is the error of XPaths that select nothing.
+var errXpathNotFound = fmt.Errorf("Xpath not found")
 
-	nodes, e := root.Search(xpath)
+func searchXpath(doc *html.HtmlDocument, xpath string, vars map[string]interface{}) (string, error) {
+	nodes, e := searchNodes(doc, xpath, vars)
 	if e != nil {
 		return "", e
 	}
 	if len(nodes) < 1 {
-		return "", fmt.Errorf("Xpath not found")
+		return "", errXpathNotFound
 	}
 
 	res := nodes[0].Content()
@@ -99,15 +236,64 @@ func convertToUtf8(bytez []byte, contentType string) ([]byte, error) {
 	return utf8bytes, e
 }
 
+// maxQueryBodySize limits the size of the body of POST /get.
+const maxQueryBodySize = 64 << 10
+
 type query struct {
-	URL   string `json:"url"`
-	Xpath string `json:"xpath"`
+	URL   string `json:"url" xml:"url"`
+	Xpath string `json:"xpath" xml:"xpath"`
+	// CSS is a selector given instead of Xpath, which it is translated to.
+	CSS string `json:"css,omitempty" xml:"css,omitempty"`
+	// Vars binds the variables the XPath references, e.g. $name, to
+	// strings, numbers or booleans.
+	Vars    map[string]interface{} `json:"vars,omitempty" xml:"-"`
+	Options *queryOptions          `json:"options,omitempty" xml:"options,omitempty"`
+}
+
+type queryOptions struct {
+	// MaxAge overrides the upstream freshness of a cached page: a cached
+	// copy younger than MaxAge seconds is used, an older one is revalidated.
+	MaxAge *int `json:"max_age,omitempty" xml:"max_age,omitempty"`
+	// NoCache forces revalidation of a cached copy with the upstream server.
+	NoCache bool `json:"no_cache,omitempty" xml:"no_cache,omitempty"`
+	// Robots refuses URLs disallowed for getxpath by the site's robots.txt.
+	Robots bool `json:"robots,omitempty" xml:"robots,omitempty"`
+	// ContentType overrides the media type and charset of the document.
+	ContentType string `json:"content_type,omitempty" xml:"content_type,omitempty"`
+	// Matches adds the number of nodes selected and a description of the
+	// first of them to the result.
+	Matches bool `json:"matches,omitempty" xml:"matches,omitempty"`
+	// Explain adds how far the XPath got to the result if it selects
+	// nothing.
+	Explain bool `json:"explain,omitempty" xml:"explain,omitempty"`
 }
 
 type result struct {
-	Query  interface{} `json:"query"`
-	Result string      `json:"result"`
-	Error  interface{} `json:"error"`
+	XMLName xml.Name    `json:"-" xml:"getxpath"`
+	Query   interface{} `json:"query" xml:"query"`
+	Result  string      `json:"result" xml:"result"`
+	Error   interface{} `json:"error" xml:"error,omitempty"`
+	// ErrorCode is a machine readable code for some errors, e.g. robots_disallowed.
+	ErrorCode string `json:"error_code,omitempty" xml:"error_code,omitempty"`
+	Cache     string `json:"cache,omitempty" xml:"cache,omitempty"`
+	// QueueWaitMs is the time in milliseconds the upstream fetch was held
+	// back by per-host rate limits.
+	QueueWaitMs int64 `json:"queue_wait_ms,omitempty" xml:"queue_wait_ms,omitempty"`
+	// MatchCount and Matches are set for queries with the matches option.
+	MatchCount int     `json:"match_count,omitempty" xml:"match_count,omitempty"`
+	Matches    []match `json:"matches,omitempty" xml:"match,omitempty"`
+	// Explanation is set for queries with the explain option whose XPath
+	// selects nothing.
+	Explanation *explanation `json:"explanation,omitempty" xml:"explanation,omitempty"`
+}
+
+// fetchInfo describes how the document for a query was obtained and, for
+// queries with the matches or explain option, what the XPath selected.
+type fetchInfo struct {
+	Cache       string
+	QueueWait   time.Duration
+	Matches     *matchSet
+	Explanation *explanation
 }
 
 var status = &statusData{}
@@ -123,48 +309,225 @@ type statusData struct {
 	LastOk         time.Time
 	LastError      time.Time
 	BytesProcessed int64
+
+	Cache      cacheStats
+	Documents  documentCacheStats
+	XPaths     expressionCacheStats
+	Coalescing coalescingStats
+	Admission  admissionStats
+	Clients    map[string]clientUsage `json:",omitempty"`
 }
 
-func requestHandler(writer http.ResponseWriter, req *http.Request) {
+// startRequest does the bookkeeping common to the handlers at the start of
+// a request: it notes the first request served and logs this one.
+func startRequest(req *http.Request) {
 	if (status.FirstRequest == time.Time{}) {
 		status.FirstRequest = time.Now()
 	}
-	logger.Print(req)
-	writer.Header().Add("Content-Type", "application/json; charset=utf-8")
+	logRequest(req)
+}
 
-	q := query{
-		URL:   req.FormValue("url"),
-		Xpath: req.FormValue("xpath"),
+// countResult updates the OK and error counters of /_status with the
+// outcome of a request.
+func countResult(failed bool) {
+	if failed {
+		status.LastError = time.Now()
+		status.ErrorCount++
+	} else {
+		status.LastOk = time.Now()
+		status.OkCount++
+	}
+}
+
+// setExtraction fills in the outcome of extracting a query.
+func (res *result) setExtraction(content string, info fetchInfo, e error) {
+	res.Result = content
+	res.Error = errorMessageOrNil(e)
+	res.ErrorCode = errorCode(e)
+	res.Cache = info.Cache
+	res.QueueWaitMs = int64(info.QueueWait / time.Millisecond)
+	if info.Matches != nil {
+		res.MatchCount = info.Matches.Count
+		res.Matches = info.Matches.Matches
 	}
+	res.Explanation = info.Explanation
+}
+
+func requestHandler(writer http.ResponseWriter, req *http.Request) {
+	startRequest(req)
+	format, formatErr := negotiateFormat(req)
 
+	q, code, queryErr := parseQuery(writer, req)
+	p := policies.policyFor(apiKey(req))
 	res := result{
 		Query: q,
 	}
-	if len(q.URL) > 0 && len(q.Xpath) > 0 {
-		content, e := extractXpathFromURL(q.URL, q.Xpath)
-		res.Result = content
-		res.Error = errorMessageOrNil(e)
+	if formatErr != nil {
+		code = 400
+		res.Error = formatErr.Error()
+	} else if queryErr != nil {
+		res.Error = queryErr.Error()
+	} else if e := p.check(q.URL); e != nil {
+		code = 403
+		res.Error = e.Error()
+		res.ErrorCode = errorCode(e)
+	} else {
+		code = 200
+		ctx := withFetchChecks(req.Context(), &fetchChecks{policy: p})
+		content, info, e := extractQuery(ctx, q)
+		res.setExtraction(content, info, e)
+		if isInvalidQuery(e) {
+			code = 400
+		} else if errorCode(e) == "policy_denied" {
+			code = 403
+		}
 		if e != nil {
 			logger.Printf("ERROR: Could not get xpath for query %v because: %v", q, e)
 		}
-	} else {
-		writer.WriteHeader(400)
-		res.Error = "Need both url and xpath query parameter."
 	}
 
-	if res.Error != nil {
-		status.LastError = time.Now()
-		status.ErrorCount++
-	} else {
-		status.LastOk = time.Now()
-		status.OkCount++
+	countResult(res.Error != nil)
+	writeResult(writer, format, code, res)
+}
+
+// parseQuery reads the query from the URL parameters of a GET request or
+// from the JSON or form body of a POST request. On failure it returns the
+// HTTP status code to answer with.
+func parseQuery(writer http.ResponseWriter, req *http.Request) (query, int, error) {
+	switch req.Method {
+	case "GET", "HEAD":
+		return parseQueryValues(req.URL.Query())
+	case "POST":
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			return parseQueryJSON(req.Body)
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			req.Body = http.MaxBytesReader(writer, req.Body, maxQueryBodySize)
+			if e := req.ParseMultipartForm(maxQueryBodySize); e != nil && e != http.ErrNotMultipart {
+				return query{}, 400, fmt.Errorf("Invalid form body: %v", e)
+			}
+			return parseQueryValues(req.PostForm)
+		}
+		return query{}, 415, fmt.Errorf("POST needs an application/json, application/x-www-form-urlencoded or multipart/form-data body.")
+	}
+	return query{}, 405, fmt.Errorf("Only GET and POST are supported.")
+}
+
+func parseQueryValues(values neturl.Values) (query, int, error) {
+	options, e := parseQueryOptions(values)
+	vars, varsErr := parseVariables(values)
+	if e == nil {
+		e = varsErr
 	}
+	q := query{
+		URL:     values.Get("url"),
+		Xpath:   values.Get("xpath"),
+		CSS:     values.Get("css"),
+		Vars:    vars,
+		Options: options,
+	}
+	if e != nil {
+		return q, 400, e
+	}
+	if e := translateCSS(&q); e != nil {
+		return q, 400, e
+	}
+	if len(q.URL) == 0 || len(q.Xpath) == 0 {
+		return q, 400, fmt.Errorf("Need both url and xpath query parameter.")
+	}
+	return q, 0, nil
+}
 
-	bytes, e := json.Marshal(res)
+func parseQueryJSON(body io.Reader) (query, int, error) {
+	var q query
+	bytez, e := ioutil.ReadAll(io.LimitReader(body, maxQueryBodySize+1))
 	if e != nil {
-		panic(e)
+		return q, 400, e
 	}
-	writer.Write(bytes)
+	if len(bytez) > maxQueryBodySize {
+		return q, 413, fmt.Errorf("Request body exceeds %d bytes.", maxQueryBodySize)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bytez))
+	decoder.DisallowUnknownFields()
+	if e := decoder.Decode(&q); e != nil {
+		return q, 400, fmt.Errorf("Invalid JSON body: %v", e)
+	}
+	if decoder.More() {
+		return q, 400, fmt.Errorf("Invalid JSON body: unexpected data after the query object")
+	}
+	if q.Options != nil && q.Options.MaxAge != nil && *q.Options.MaxAge < 0 {
+		return q, 400, fmt.Errorf("max_age must be a non-negative number of seconds.")
+	}
+	if e := translateCSS(&q); e != nil {
+		return q, 400, e
+	}
+	if len(q.URL) == 0 || len(q.Xpath) == 0 {
+		return q, 400, fmt.Errorf("Need both url and xpath in the query.")
+	}
+	return q, 0, nil
+}
+
+func parseQueryOptions(values neturl.Values) (*queryOptions, error) {
+	var options queryOptions
+	if v := values.Get("max_age"); v != "" {
+		maxAge, e := strconv.Atoi(v)
+		if e != nil || maxAge < 0 {
+			return nil, fmt.Errorf("max_age must be a non-negative number of seconds.")
+		}
+		options.MaxAge = &maxAge
+	}
+	if v := values.Get("no_cache"); v != "" {
+		noCache, e := strconv.ParseBool(v)
+		if e != nil {
+			return nil, fmt.Errorf("no_cache must be true or false.")
+		}
+		options.NoCache = noCache
+	}
+	if v := values.Get("robots"); v != "" {
+		robots, e := strconv.ParseBool(v)
+		if e != nil {
+			return nil, fmt.Errorf("robots must be true or false.")
+		}
+		options.Robots = robots
+	}
+	options.ContentType = values.Get("content_type")
+	if v := values.Get("matches"); v != "" {
+		matches, e := strconv.ParseBool(v)
+		if e != nil {
+			return nil, fmt.Errorf("matches must be true or false.")
+		}
+		options.Matches = matches
+	}
+	if v := values.Get("explain"); v != "" {
+		explain, e := strconv.ParseBool(v)
+		if e != nil {
+			return nil, fmt.Errorf("explain must be true or false.")
+		}
+		options.Explain = explain
+	}
+
+	if options == (queryOptions{}) {
+		return nil, nil
+	}
+	return &options, nil
+}
+
+// translateCSS sets the XPath of a query given a CSS selector.
+func translateCSS(q *query) error {
+	if q.CSS == "" {
+		return nil
+	}
+	if q.Xpath != "" {
+		return fmt.Errorf("Give either xpath or css, not both.")
+	}
+	xpath, e := cssToXpath(q.CSS)
+	if e != nil {
+		return e
+	}
+	q.Xpath = xpath
+	return nil
 }
 
 func errorMessageOrNil(e error) interface{} {
@@ -174,54 +537,74 @@ func errorMessageOrNil(e error) interface{} {
 	return nil
 }
 
-func parseCommandLineArgs() (string, string, int) {
-	url := flag.String("url", "", "URL to fetch")
-	xpath := flag.String("xpath", "", "XPath to extract from the document at <url>")
-	port := flag.Int("port", 0, "Port in server mode")
-	flag.Parse()
+// queryError is an error reported along with a machine readable code.
+type queryError struct {
+	Code    string
+	Message string
+}
 
-	return *url, *xpath, *port
+func (e *queryError) Error() string {
+	return e.Message
 }
 
-func runTestUsingCommentLineArgs(url string, xpath string) {
-	if len(url) > 0 && len(xpath) > 0 {
-		content, _ := extractXpathFromURL(url, xpath)
-		fmt.Printf("EXTRACTED: `%s`\n", content)
+func errorCode(e error) string {
+	if qe, ok := e.(*queryError); ok {
+		return qe.Code
 	}
+	return ""
+}
+
+// isInvalidQuery tells whether e is the fault of the query rather than of
+// the document.
+func isInvalidQuery(e error) bool {
+	switch errorCode(e) {
+	case "invalid_xpath", "invalid_variable", "undefined_variable":
+		return true
+	}
+	return false
 }
 
 func statusHandler(writer http.ResponseWriter, req *http.Request) {
-	logger.Print(req)
+	logRequest(req)
 	writer.Header().Add("Content-Type", "application/json")
 
-	bytes, e := json.MarshalIndent(status, "", "  ")
+	snapshot := *status
+	snapshot.Cache = bodyCache.stats()
+	snapshot.Documents = documents.stats()
+	snapshot.XPaths = expressions.stats()
+	snapshot.Coalescing = coalescing()
+	snapshot.Admission = extractions.currentStats()
+	snapshot.Clients = auth.usage()
+
+	bytes, e := json.MarshalIndent(snapshot, "", "  ")
 	if e != nil {
 		logger.Panic(e)
 	}
 	writer.Write(bytes)
 }
 
-func startServer(port int) {
-	http.HandleFunc("/_status", statusHandler)
-	http.HandleFunc("/get", requestHandler)
-
-	e := http.ListenAndServe(":"+strconv.Itoa(port), nil)
+func startServer(port int) error {
+	http.HandleFunc("/_status", withCORS(requireScope(scopeStatus, statusHandler)))
+	http.HandleFunc("/get", withCORS(requireScope(scopeGet, limitConcurrency(requestHandler))))
+	http.HandleFunc("/suggest", withCORS(requireScope(scopeGet, limitConcurrency(suggestHandler))))
+	http.HandleFunc("/extract", withCORS(requireScope(scopeGet, limitConcurrency(extractHandler))))
+	http.HandleFunc("/batch", withCORS(requireScope(scopeBatch, limitConcurrency(batchHandler))))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/", uiHandler)
+
+	listener, e := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if e != nil {
-		panic(e)
+		return e
 	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	return serve(newServer(http.DefaultServeMux), listener, stop)
 }
 
 func main() {
-	url, xpath, port := parseCommandLineArgs()
-
-	if port > 0 {
-		startServer(port)
-	} else if url != "" && xpath != "" {
-		runTestUsingCommentLineArgs(url, xpath)
-	} else {
-		flag.PrintDefaults()
-	}
-
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
 }
 
 func init() {
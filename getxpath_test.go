@@ -2,6 +2,10 @@ package main
 
 import "testing"
 import "strings"
+import "context"
+import "net/http"
+import "net/http/httptest"
+import "time"
 
 func TestBasic(t *testing.T) {
 	xpath := "//title"
@@ -72,3 +76,67 @@ func expectContainsString(t *testing.T, expected string, uri string, xpath strin
 		t.Errorf("Expected '%v' to contain '%v'", actual, expected)
 	}
 }
+
+func TestParseQueryFromJSONBody(t *testing.T) {
+	body := `{"url": "http://example.com", "xpath": "//a[@title=\"x\"]", "options": {"max_age": 60}}`
+	q, _, e := parseQuery(httptest.NewRecorder(), newPostRequest("application/json; charset=utf-8", body))
+	if e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	if q.URL != "http://example.com" || q.Xpath != `//a[@title="x"]` || q.Options == nil || *q.Options.MaxAge != 60 {
+		t.Errorf("Got %+v", q)
+	}
+}
+
+func TestParseQueryRejectsInvalidBodies(t *testing.T) {
+	for body, expected := range map[string]int{
+		`{"url": "http://example.com", "xpath": "//title", "xpaht": "typo"}`:                      400,
+		`{"url": "http://example.com", "xpath": "//title", "options": {"x": 1}}`:                  400,
+		`{"url": "http://example.com"}`:                                                           400,
+		`{"url": "http://example.com", "xpath": "//title"} {}`:                                    400,
+		`{"url": "http://example.com", "xpath": "` + strings.Repeat("x", maxQueryBodySize) + `"}`: 413,
+	} {
+		_, code, e := parseQuery(httptest.NewRecorder(), newPostRequest("application/json", body))
+		if e == nil || code != expected {
+			t.Errorf("Got (%d, %v) for %.80v, wanted %d", code, e, body, expected)
+		}
+	}
+
+	_, code, e := parseQuery(httptest.NewRecorder(), newPostRequest("text/plain", "url=x"))
+	if code != 415 || e == nil || !strings.Contains(e.Error(), "application/x-www-form-urlencoded") {
+		t.Errorf("Got (%d, %v) for text/plain, wanted 415 listing the accepted types", code, e)
+	}
+}
+
+func TestParseQueryFromGetParameters(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/get?url=http://example.com&xpath=//title&no_cache=true", nil)
+	q, _, e := parseQuery(httptest.NewRecorder(), req)
+	if e != nil || q.URL != "http://example.com" || q.Xpath != "//title" || !q.Options.NoCache {
+		t.Errorf("Got (%+v, %v)", q, e)
+	}
+}
+
+func newPostRequest(contentType string, body string) *http.Request {
+	req, _ := http.NewRequest("POST", "/get", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func TestFetchRetriesStopAtTheDeadline(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, e := readBodyFromURL(ctx, server.URL, http.Header{}); e == nil {
+		t.Errorf("Expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("Retrying took %v, past the deadline", elapsed)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// reservedNets are the destinations refused unless explicitly allowed:
+// loopback, private, link-local, shared and otherwise reserved ranges.
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+var guard = &destinationGuard{enabled: true}
+
+// destinationGuard decides which hosts and addresses outbound fetches may
+// connect to. Denied hosts and networks are always refused; allowed ones
+// are exempt from the reserved ranges check.
+type destinationGuard struct {
+	enabled    bool
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	allowHosts []string
+	denyHosts  []string
+}
+
+func destinationForbidden(format string, args ...interface{}) error {
+	return &queryError{Code: "destination_forbidden", Message: fmt.Sprintf(format, args...)}
+}
+
+func (g *destinationGuard) checkHost(host string) (bool, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchesHostGlob(g.denyHosts, host) {
+		return false, destinationForbidden("Fetching from host %s is forbidden", host)
+	}
+	return matchesHostGlob(g.allowHosts, host), nil
+}
+
+func (g *destinationGuard) checkIP(host string, ip net.IP) error {
+	if containsIP(g.denyNets, ip) {
+		return destinationForbidden("Fetching from %s (%s) is forbidden", host, ip)
+	}
+	if containsIP(reservedNets, ip) && !containsIP(g.allowNets, ip) {
+		return destinationForbidden("Fetching from %s (%s) is forbidden: private or reserved address", host, ip)
+	}
+	return nil
+}
+
+// dialContext resolves the host itself and connects only to addresses that
+// pass the guard. Since the connection goes to exactly the checked address,
+// a DNS answer changing between check and connect cannot sneak past it, and
+// every redirect needing a new connection is checked again.
+func (g *destinationGuard) dialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if !g.enabled {
+			return dialer.DialContext(ctx, network, address)
+		}
+		host, port, e := net.SplitHostPort(address)
+		if e != nil {
+			return nil, e
+		}
+		allowedHost, e := g.checkHost(host)
+		if e != nil {
+			return nil, e
+		}
+
+		addrs, e := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if e != nil {
+			return nil, e
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("No addresses found for %s", host)
+		}
+		if !allowedHost {
+			for _, addr := range addrs {
+				if e := g.checkIP(host, addr.IP); e != nil {
+					return nil, e
+				}
+			}
+		}
+
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, e = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if e == nil {
+				return conn, nil
+			}
+		}
+		return nil, e
+	}
+}
+
+func matchesHostGlob(globs []string, host string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, e := parseCIDRList(strings.Join(cidrs, ","))
+	if e != nil {
+		panic(e)
+	}
+	return nets
+}
+
+// parseCIDRList parses a comma separated list of CIDRs or single addresses.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range splitList(list) {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(s)
+		if e != nil {
+			return nil, e
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, strings.ToLower(item))
+		}
+	}
+	return items
+}
+
+func newGuardedTransport(g *destinationGuard) *politeTransport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &politeTransport{
+		limiter: hosts,
+		next: &http.Transport{
+			DialContext:           g.dialContext(dialer),
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// allowLoopback lets the guard fetch from httptest servers, which listen
+// on the loopback interface, until the returned function is called.
+func allowLoopback() func() {
+	saved := guard.allowNets
+	guard.allowNets = parseCIDRs("127.0.0.0/8", "::1")
+	return func() { guard.allowNets = saved }
+}
+
+func TestGuardRefusesReservedAddresses(t *testing.T) {
+	g := &destinationGuard{enabled: true}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:10.0.0.1"} {
+		if e := g.checkIP("host", net.ParseIP(ip)); errorCode(e) != "destination_forbidden" {
+			t.Errorf("Expected %v to be forbidden, got %v", ip, e)
+		}
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if e := g.checkIP("host", net.ParseIP(ip)); e != nil {
+			t.Errorf("Expected %v to be allowed, got %v", ip, e)
+		}
+	}
+}
+
+func TestGuardAllowAndDenyLists(t *testing.T) {
+	g := &destinationGuard{
+		enabled:    true,
+		allowNets:  parseCIDRs("10.0.0.0/24"),
+		denyNets:   parseCIDRs("93.184.216.0/24"),
+		allowHosts: []string{"*.internal.example.com"},
+		denyHosts:  []string{"evil.example.com"},
+	}
+
+	if e := g.checkIP("host", net.ParseIP("10.0.0.5")); e != nil {
+		t.Errorf("Expected allowed network to be exempt, got %v", e)
+	}
+	if e := g.checkIP("host", net.ParseIP("10.0.1.5")); e == nil {
+		t.Errorf("Expected private address outside the allowed network to be forbidden")
+	}
+	if e := g.checkIP("host", net.ParseIP("93.184.216.34")); e == nil {
+		t.Errorf("Expected denied network to be forbidden")
+	}
+	if allowed, _ := g.checkHost("api.internal.example.com"); !allowed {
+		t.Errorf("Expected host glob to allow api.internal.example.com")
+	}
+	if _, e := g.checkHost("evil.example.com."); e == nil {
+		t.Errorf("Expected denied host to be forbidden")
+	}
+}
+
+func TestGuardRefusesRedirectToReservedAddress(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testPage)
+	}))
+	defer internal.Close()
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+	redirector := httptest.NewServer(http.RedirectHandler("http://localhost:"+port+"/", http.StatusFound))
+	defer redirector.Close()
+
+	// Only the redirector's host is allowed, the redirect target is not.
+	g := &destinationGuard{enabled: true, allowHosts: []string{"127.0.0.1"}}
+	client := &http.Client{Transport: newGuardedTransport(g)}
+
+	if _, e := client.Get(internal.URL); e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+	_, e := client.Get(redirector.URL)
+	if ue, ok := e.(*url.Error); !ok || errorCode(ue.Err) != "destination_forbidden" {
+		t.Errorf("Got %v, wanted destination_forbidden", e)
+	}
+}
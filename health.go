@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// selfTestOnReady runs the self-test extraction on every readiness check,
+// not only on those asking for it with self_test=true.
+var selfTestOnReady = false
+
+const (
+	selfTestDocument = `<html><head><meta charset="iso-8859-1"><title>getxpath self-test</title></head>` +
+		`<body><p id="umlauts">M` + "\xfc" + `nchen</p></body></html>`
+	selfTestXpath    = `//p[@id="umlauts"]`
+	selfTestExpected = "München"
+)
+
+type healthCheck struct {
+	OK         bool        `json:"ok"`
+	Error      string      `json:"error,omitempty"`
+	Detail     interface{} `json:"detail,omitempty"`
+	DurationMs float64     `json:"duration_ms"`
+}
+
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// healthzHandler tells that the process is alive and serving HTTP.
+func healthzHandler(writer http.ResponseWriter, req *http.Request) {
+	writeHealth(writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler tells whether the server should receive traffic: it is not
+// ready while starting or draining, or when one of its checks fails.
+func readyzHandler(writer http.ResponseWriter, req *http.Request) {
+	checks := map[string]func() (interface{}, error){
+		"server": checkServer,
+	}
+	if selfTest, _ := strconv.ParseBool(req.URL.Query().Get("self_test")); selfTest || selfTestOnReady {
+		checks["self_test"] = checkSelfTest
+	}
+
+	r := readiness{Ready: true, Checks: make(map[string]healthCheck)}
+	for name, check := range checks {
+		start := time.Now()
+		detail, e := check()
+		c := healthCheck{OK: e == nil, Detail: detail, DurationMs: float64(time.Since(start)) / float64(time.Millisecond)}
+		if e != nil {
+			c.Error = e.Error()
+			r.Ready = false
+		}
+		r.Checks[name] = c
+	}
+
+	code := http.StatusOK
+	if !r.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(writer, code, r)
+}
+
+func checkServer() (interface{}, error) {
+	if !isReady() {
+		return nil, fmt.Errorf("Server is starting or shutting down")
+	}
+	return nil, nil
+}
+
+// checkSelfTest runs a built-in document through charset conversion,
+// parsing and XPath search, without touching the network or the caches.
+func checkSelfTest() (interface{}, error) {
+	utf8bytes, e := convertToUtf8([]byte(selfTestDocument), "text/html")
+	if e != nil {
+		return nil, e
+	}
+	doc, e := parseHtml(utf8bytes)
+	if e != nil {
+		return nil, e
+	}
+	defer doc.Free()
+
+	content, e := searchXpath(doc, selfTestXpath, nil)
+	if e != nil {
+		return nil, e
+	}
+	if content != selfTestExpected {
+		return content, fmt.Errorf("Self-test extracted '%s' instead of '%s'", content, selfTestExpected)
+	}
+	return content, nil
+}
+
+func writeHealth(writer http.ResponseWriter, code int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(code)
+	bytes, e := json.Marshal(v)
+	if e != nil {
+		logger.Panic(e)
+	}
+	writer.Write(bytes)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadyzReportsDraining(t *testing.T) {
+	defer atomic.StoreInt32(&ready, atomic.LoadInt32(&ready))
+
+	atomic.StoreInt32(&ready, 1)
+	if code, r := getReadyz(t, "/readyz?self_test=true"); code != 200 || !r.Ready || !r.Checks["self_test"].OK {
+		t.Errorf("Got %d %+v, wanted ready", code, r)
+	}
+
+	atomic.StoreInt32(&ready, 0)
+	if code, r := getReadyz(t, "/readyz"); code != 503 || r.Ready || r.Checks["server"].OK {
+		t.Errorf("Got %d %+v, wanted not ready", code, r)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if content, e := checkSelfTest(); e != nil {
+		t.Errorf("Got (%v, %v), wanted the self-test to pass", content, e)
+	}
+}
+
+func getReadyz(t *testing.T, target string) (int, readiness) {
+	req, _ := http.NewRequest("GET", target, nil)
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, req)
+
+	var r readiness
+	if e := json.Unmarshal(recorder.Body.Bytes(), &r); e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	return recorder.Code, r
+}
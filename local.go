@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stdinURL is the URL of the document read from standard input.
+const stdinURL = "-"
+
+// localFiles controls reading documents from file:// URLs and stdin. The
+// command-line tool reads any file and stdin; the server reads files only
+// when given a root directory they must lie within.
+var localFiles = struct {
+	enabled bool
+	stdin   bool
+	root    string
+}{}
+
+var stdin io.Reader = os.Stdin
+
+func isLocalURL(url string) bool {
+	return url == stdinURL || strings.HasPrefix(strings.ToLower(url), "file:")
+}
+
+func localFileForbidden(format string, args ...interface{}) error {
+	return &queryError{Code: "local_file_forbidden", Message: fmt.Sprintf(format, args...)}
+}
+
+// readLocal reads the document at a file:// URL or, for -, from stdin.
+func readLocal(url string) (*upstreamResponse, error) {
+	var body []byte
+	var e error
+	if url == stdinURL {
+		if !localFiles.stdin {
+			return nil, localFileForbidden("Reading from stdin is not allowed.")
+		}
+		body, e = ioutil.ReadAll(stdin)
+	} else {
+		var path string
+		if path, e = localPath(url); e != nil {
+			return nil, e
+		}
+		body, e = ioutil.ReadFile(path)
+	}
+	if e != nil {
+		return nil, e
+	}
+	return &upstreamResponse{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}, nil
+}
+
+// localPath returns the path of the file at a file:// URL after checking
+// that it may be read.
+func localPath(url string) (string, error) {
+	if !localFiles.enabled {
+		return "", localFileForbidden("file:// URLs are not allowed.")
+	}
+	u, e := neturl.Parse(url)
+	if e != nil {
+		return "", e
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", localFileForbidden("file:// URLs must not name a host.")
+	}
+	if u.Path == "" || !filepath.IsAbs(filepath.FromSlash(u.Path)) {
+		return "", fmt.Errorf("file:// URLs need an absolute path, as in file:///tmp/page.html.")
+	}
+	path := filepath.FromSlash(u.Path)
+	if localFiles.root == "" {
+		return path, nil
+	}
+
+	// Resolve symlinks so they cannot point outside the root.
+	resolved, e := filepath.EvalSymlinks(path)
+	if e != nil {
+		return "", e
+	}
+	if !withinDir(localFiles.root, resolved) {
+		return "", localFileForbidden("%s is outside of the directory files may be read from.", u.Path)
+	}
+	return resolved, nil
+}
+
+func withinDir(dir, path string) bool {
+	rel, e := filepath.Rel(dir, path)
+	return e == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveRoot returns the absolute, symlink free path of the directory dir.
+func resolveRoot(dir string) (string, error) {
+	abs, e := filepath.Abs(dir)
+	if e != nil {
+		return "", e
+	}
+	resolved, e := filepath.EvalSymlinks(abs)
+	if e != nil {
+		return "", e
+	}
+	info, e := os.Stat(resolved)
+	if e != nil {
+		return "", e
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return resolved, nil
+}
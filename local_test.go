@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLocalPage(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if e := ioutil.WriteFile(path, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return path
+}
+
+func TestExtractFromFileURL(t *testing.T) {
+	defer func(saved bool) { localFiles.enabled = saved }(localFiles.enabled)
+	localFiles.enabled = true
+	dir, _ := ioutil.TempDir("", "getxpath-local")
+	path := writeLocalPage(t, dir, "page.html", "<html><head><title>Saved Page</title></head></html>")
+
+	actual, e := extractXpathFromURL("file://"+filepath.ToSlash(path), "//title")
+	if e != nil || actual != "Saved Page" {
+		t.Errorf("Got '%v', %v", actual, e)
+	}
+}
+
+func TestFileURLsForbiddenByDefault(t *testing.T) {
+	_, e := extractXpathFromURL("file:///etc/passwd", "//title")
+	if errorCode(e) != "local_file_forbidden" {
+		t.Errorf("Got %v", e)
+	}
+	_, e = extractXpathFromURL(stdinURL, "//title")
+	if errorCode(e) != "local_file_forbidden" {
+		t.Errorf("Got %v", e)
+	}
+}
+
+func TestFileURLsRestrictedToRoot(t *testing.T) {
+	defer func(enabled bool, root string) { localFiles.enabled, localFiles.root = enabled, root }(localFiles.enabled, localFiles.root)
+	outside, _ := ioutil.TempDir("", "getxpath-outside")
+	secret := writeLocalPage(t, outside, "secret.html", "<html><title>Secret</title></html>")
+	dir, _ := ioutil.TempDir("", "getxpath-root")
+	page := writeLocalPage(t, dir, "page.html", "<html><title>Public</title></html>")
+	os.Symlink(secret, filepath.Join(dir, "link.html"))
+
+	root, e := resolveRoot(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	localFiles.enabled, localFiles.root = true, root
+
+	if actual, e := extractXpathFromURL("file://"+page, "//title"); e != nil || actual != "Public" {
+		t.Errorf("Got '%v', %v", actual, e)
+	}
+	for _, path := range []string{secret, filepath.Join(dir, "..", filepath.Base(outside), "secret.html"), filepath.Join(dir, "link.html")} {
+		if _, e := extractXpathFromURL("file://"+path, "//title"); errorCode(e) != "local_file_forbidden" {
+			t.Errorf("Expected %s to be forbidden, got %v", path, e)
+		}
+	}
+}
+
+func TestGetCommandFromStdinWithContentType(t *testing.T) {
+	defer saveSettings()()
+	defer func() { stdin = os.Stdin }()
+	stdin = strings.NewReader("<html><body><p>M\xfcnchen</p></body></html>")
+
+	code, stdout, stderr := runTestCommand("get", "-content-type", "text/html; charset=iso-8859-1", "-", "//p")
+	if code != exitOK || stdout != "München\n" {
+		t.Errorf("Got exit code %d and '%s' (%s)", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/moovweb/gokogiri/xml"
+)
+
+// voidElements have no end tag in HTML.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// outerHTML serializes a node and its descendants. gokogiri's own
+// serialization passes Go pointers to C and fails the cgo pointer checks.
+// Attributes are written in alphabetical order.
+func outerHTML(node xml.Node) string {
+	var buf bytes.Buffer
+	writeHTML(&buf, node)
+	return buf.String()
+}
+
+func writeHTML(buf *bytes.Buffer, node xml.Node) {
+	switch node.NodeType() {
+	case xml.XML_ELEMENT_NODE:
+		name := strings.ToLower(node.Name())
+		buf.WriteString("<" + name)
+		attributes := node.Attributes()
+		names := make([]string, 0, len(attributes))
+		for attr := range attributes {
+			names = append(names, attr)
+		}
+		sort.Strings(names)
+		for _, attr := range names {
+			buf.WriteString(" " + attr + `="` + html.EscapeString(attributes[attr].Value()) + `"`)
+		}
+		buf.WriteString(">")
+		if voidElements[name] {
+			return
+		}
+		for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+			writeHTML(buf, child)
+		}
+		buf.WriteString("</" + name + ">")
+	case xml.XML_TEXT_NODE:
+		if parent := node.Parent(); parent != nil && (parent.Name() == "script" || parent.Name() == "style") {
+			buf.WriteString(node.Content())
+		} else {
+			buf.WriteString(html.EscapeString(node.Content()))
+		}
+	case xml.XML_CDATA_SECTION_NODE:
+		buf.WriteString(node.Content())
+	case xml.XML_COMMENT_NODE:
+		buf.WriteString("<!--" + node.Content() + "-->")
+	case xml.XML_ATTRIBUTE_NODE:
+		buf.WriteString(html.EscapeString(node.Content()))
+	default:
+		for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+			writeHTML(buf, child)
+		}
+	}
+}
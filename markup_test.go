@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestOuterHTML(t *testing.T) {
+	doc, e := parseHtml([]byte(`<html><body><div id="x" class="a &amp; b"><br>1 &lt; 2<!-- note --><script>if (a < b) {}</script></div></body></html>`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+	nodes, _ := doc.Root().Search("//div")
+
+	expected := `<div class="a &amp; b" id="x"><br>1 &lt; 2<!-- note --><script>if (a < b) {}</script></div>`
+	if actual := outerHTML(nodes[0]); actual != expected {
+		t.Errorf("Got '%s', wanted '%s'", actual, expected)
+	}
+}
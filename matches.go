@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/moovweb/gokogiri/xml"
+)
+
+const (
+	// maxMatches limits the matches described per query.
+	maxMatches = 20
+	// maxContextLength is the longest parent markup shown around a match.
+	maxContextLength = 2000
+)
+
+// match describes a node selected by an XPath.
+type match struct {
+	Path string `json:"path" xml:"path"`
+	Text string `json:"text" xml:"text"`
+	HTML string `json:"html" xml:"html"`
+	// Context is the markup of the parent containing HTML, or HTML itself
+	// if the parent is too large.
+	Context string `json:"context" xml:"context"`
+	// Offset is the byte offset of HTML in Context. The same markup may
+	// occur in Context more than once.
+	Offset int `json:"offset" xml:"offset"`
+}
+
+// matchSet is the number of nodes an XPath selects and the first of them.
+type matchSet struct {
+	Count   int
+	Matches []match
+}
+
+// searchMatches evaluates xpath like search and also describes the nodes it
+// selects, holding the search lock like search does.
+func (d *parsedDoc) searchMatches(xpath string, vars map[string]interface{}) (string, *matchSet, error) {
+	d.searchMu.Lock()
+	defer d.searchMu.Unlock()
+
+	nodes, e := searchNodes(d.doc, xpath, vars)
+	if e != nil {
+		return "", nil, e
+	}
+	if len(nodes) < 1 {
+		return "", &matchSet{}, errXpathNotFound
+	}
+
+	set := &matchSet{Count: len(nodes)}
+	for i, node := range nodes {
+		if i == maxMatches {
+			break
+		}
+		set.Matches = append(set.Matches, describeMatch(node))
+	}
+	return nodes[0].Content(), set, nil
+}
+
+func describeMatch(node xml.Node) match {
+	m := match{
+		Path: node.Path(),
+		Text: strings.TrimSpace(node.Content()),
+		HTML: outerHTML(node),
+	}
+	m.Context = m.HTML
+	if parent := node.Parent(); parent != nil && parent.NodeType() == xml.XML_ELEMENT_NODE {
+		if context := outerHTML(parent); len(context) <= maxContextLength {
+			m.Context = context
+			m.Offset = offsetInParent(context, node)
+		}
+	}
+	return m
+}
+
+// offsetInParent returns where node starts in context, the markup of its
+// parent: after the parent's start tag and the markup of the preceding
+// siblings, or for an attribute after its name in the start tag.
+func offsetInParent(context string, node xml.Node) int {
+	startTag := context[:strings.IndexByte(context, '>')+1]
+	if node.NodeType() == xml.XML_ATTRIBUTE_NODE {
+		prefix := " " + node.Name() + `="`
+		return strings.Index(startTag, prefix) + len(prefix)
+	}
+	offset := len(startTag)
+	for sibling := node.Parent().FirstChild(); sibling != nil && sibling.NodePtr() != node.NodePtr(); sibling = sibling.NextSibling() {
+		offset += len(outerHTML(sibling))
+	}
+	return offset
+}
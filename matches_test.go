@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"testing"
+)
+
+func getMatches(t *testing.T, params neturl.Values) (int, result) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, cssTestPage)
+	}))
+	defer server.Close()
+
+	params.Set("url", server.URL)
+	recorder := httptest.NewRecorder()
+	requestHandler(recorder, httptest.NewRequest("GET", "/get?"+params.Encode(), nil))
+
+	var res struct {
+		result
+		Query query `json:"query"`
+	}
+	if e := json.Unmarshal(recorder.Body.Bytes(), &res); e != nil {
+		t.Fatal(e)
+	}
+	res.result.Query = res.Query
+	return recorder.Code, res.result
+}
+
+func TestGetMatches(t *testing.T) {
+	defer allowLoopback()()
+	code, res := getMatches(t, neturl.Values{"xpath": {"//li"}, "matches": {"true"}})
+	if code != 200 || res.Result != "One" || res.MatchCount != 4 || len(res.Matches) != 4 {
+		t.Fatalf("Got %d %+v", code, res)
+	}
+	m := res.Matches[1]
+	if m.Path != "/html/body/div/ul/li[2]" || m.Text != "Two" || m.HTML != `<li class="x">Two</li>` {
+		t.Errorf("Got %+v", m)
+	}
+	if m.Context != `<ul><li>One</li><li class="x">Two</li><li>Three</li><li>Four</li></ul>` {
+		t.Errorf("Got context %s", m.Context)
+	}
+}
+
+func TestGetWithoutMatchesOption(t *testing.T) {
+	defer allowLoopback()()
+	_, res := getMatches(t, neturl.Values{"xpath": {"//li"}})
+	if res.Result != "One" || res.MatchCount != 0 || res.Matches != nil {
+		t.Errorf("Got %+v", res)
+	}
+}
+
+func TestGetCSS(t *testing.T) {
+	defer allowLoopback()()
+	code, res := getMatches(t, neturl.Values{"css": {"ul > li.x"}, "matches": {"1"}})
+	if code != 200 || res.Result != "Two" || res.MatchCount != 1 {
+		t.Errorf("Got %d %+v", code, res)
+	}
+	q := res.Query.(query)
+	if q.CSS != "ul > li.x" || q.Xpath == "" {
+		t.Errorf("Got query %+v", q)
+	}
+}
+
+func TestGetCSSErrors(t *testing.T) {
+	for _, params := range []neturl.Values{
+		{"css": {"li:hover"}},
+		{"css": {"li"}, "xpath": {"//li"}},
+		{"xpath": {"//li"}, "matches": {"maybe"}},
+	} {
+		if code, res := getMatches(t, params); code != 400 || res.Error == nil {
+			t.Errorf("Got %d %+v for %v", code, res, params)
+		}
+	}
+}
+
+func TestParseQueryJSONWithCSS(t *testing.T) {
+	q, code, e := parseQueryJSON(strings.NewReader(`{"url": "http://example.com/", "css": "h1"}`))
+	if e != nil || code != 0 || q.Xpath != "//h1" {
+		t.Errorf("Got %+v %d %v", q, code, e)
+	}
+}
+
+func TestMatchOffsets(t *testing.T) {
+	doc, e := parseHtml([]byte(`<html><body><p>Grüße <b>A</b> <b>A</b> <a href="A">x</a></p></body></html>`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+
+	for xpath, expected := range map[string]string{
+		"//b[1]":     "<b>A</b>",
+		"//b[2]":     "<b>A</b>",
+		"//a/@href":  "A",
+		"//p/text()": "Grüße ",
+	} {
+		nodes, e := doc.Root().Search(xpath)
+		if e != nil || len(nodes) == 0 {
+			t.Fatalf("Could not search %s: %v", xpath, e)
+		}
+		m := describeMatch(nodes[0])
+		if actual := m.Context[m.Offset : m.Offset+len(m.HTML)]; m.HTML != expected || actual != expected {
+			t.Errorf("Got %q at %d for %s", actual, m.Offset, xpath)
+		}
+	}
+	first, _ := doc.Root().Search("//b[1]")
+	second, _ := doc.Root().Search("//b[2]")
+	if describeMatch(first[0]).Offset == describeMatch(second[0]).Offset {
+		t.Errorf("Expected identical siblings at different offsets")
+	}
+}
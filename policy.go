@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const policyReloadInterval = 5 * time.Second
+
+var policies = &policyStore{}
+
+// policyFile is the format of the file given with -policies:
+//
+//	{
+//		"default": {"allow": [{"schemes": ["https"]}]},
+//		"keys": {
+//			"<api key>": {"allow": [{"hosts": ["*.example.com"], "path_prefixes": ["/news"]}]}
+//		}
+//	}
+//
+// A key's policy replaces the default one.
+type policyFile struct {
+	Default *policy            `json:"default"`
+	Keys    map[string]*policy `json:"keys"`
+}
+
+// policy restricts the URLs a client may query. A URL is refused when it
+// matches any deny rule, or when there are allow rules and it matches none.
+type policy struct {
+	Allow []policyRule `json:"allow"`
+	Deny  []policyRule `json:"deny"`
+}
+
+// policyRule matches a URL when every non-empty field matches it.
+type policyRule struct {
+	Hosts        []string `json:"hosts"`
+	Schemes      []string `json:"schemes"`
+	Ports        []int    `json:"ports"`
+	PathPrefixes []string `json:"path_prefixes"`
+}
+
+func (r policyRule) matches(u *url.URL) bool {
+	if len(r.Hosts) > 0 && !matchesHostGlob(lowerAll(r.Hosts), strings.ToLower(u.Hostname())) {
+		return false
+	}
+	if len(r.Schemes) > 0 && !containsString(lowerAll(r.Schemes), strings.ToLower(u.Scheme)) {
+		return false
+	}
+	if len(r.Ports) > 0 && !containsPort(r.Ports, urlPort(u)) {
+		return false
+	}
+	if len(r.PathPrefixes) > 0 {
+		p := cleanPath(u.Path)
+		for _, prefix := range r.PathPrefixes {
+			if strings.HasPrefix(p, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// cleanPath resolves the dot segments of a decoded URL path, so that
+// /reports/../admin and /reports/%2e%2e/admin both become /admin. A
+// trailing slash is kept.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func (p *policy) check(rawurl string) error {
+	if p == nil {
+		return nil
+	}
+	u, e := url.Parse(rawurl)
+	if e != nil {
+		return e
+	}
+	for _, rule := range p.Deny {
+		if rule.matches(u) {
+			return policyDenied(rawurl)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if rule.matches(u) {
+			return nil
+		}
+	}
+	return policyDenied(rawurl)
+}
+
+func policyDenied(rawurl string) error {
+	return &queryError{
+		Code:    "policy_denied",
+		Message: fmt.Sprintf("Querying %s is not allowed by the policy for this API key", rawurl),
+	}
+}
+
+// policyStore holds the policies loaded from a file and reloads them when
+// the file changes.
+type policyStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	file    policyFile
+}
+
+func (s *policyStore) policyFor(key string) *policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.file.Keys[key]; ok && key != "" {
+		return p
+	}
+	return s.file.Default
+}
+
+func (s *policyStore) check(key string, rawurl string) error {
+	return s.policyFor(key).check(rawurl)
+}
+
+// load reads the policies from path and keeps reloading them in the
+// background whenever the file's modification time changes.
+func (s *policyStore) load(path string) error {
+	s.path = path
+	if e := s.reloadIfChanged(); e != nil {
+		return e
+	}
+	go func() {
+		for range time.Tick(policyReloadInterval) {
+			if e := s.reloadIfChanged(); e != nil {
+				logger.Printf("ERROR: Could not reload policies from %s, keeping the previous ones: %v", path, e)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *policyStore) reloadIfChanged() error {
+	info, e := os.Stat(s.path)
+	if e != nil {
+		return e
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	bytes, e := ioutil.ReadFile(s.path)
+	if e != nil {
+		return e
+	}
+	var file policyFile
+	if e := json.Unmarshal(bytes, &file); e != nil {
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+	s.modTime = info.ModTime()
+	logger.Printf("Loaded policies for %d API keys from %s", len(file.Keys), s.path)
+	return nil
+}
+
+// apiKey returns the API key of a request, given in the X-API-Key header or
+// the api_key query parameter.
+func apiKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return req.URL.Query().Get("api_key")
+}
+
+// logRequest logs the method, path and query of a request. Headers are
+// left out and the api_key parameter is redacted, so that no credentials
+// end up in the log.
+func logRequest(req *http.Request) {
+	target := req.URL.Path
+	if query := req.URL.Query(); len(query) > 0 {
+		if _, ok := query["api_key"]; ok {
+			query.Set("api_key", "REDACTED")
+		}
+		target += "?" + query.Encode()
+	}
+	logger.Printf("%s %s", req.Method, target)
+}
+
+func urlPort(u *url.URL) int {
+	if port, e := strconv.Atoi(u.Port()); e == nil {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return 443
+	case "http":
+		return 80
+	}
+	return 0
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyRules(t *testing.T) {
+	p := &policy{
+		Allow: []policyRule{
+			{Hosts: []string{"*.Example.com"}, Schemes: []string{"https"}},
+			{Hosts: []string{"intranet"}, Ports: []int{8080}, PathPrefixes: []string{"/reports/"}},
+		},
+		Deny: []policyRule{{Hosts: []string{"admin.example.com"}}},
+	}
+
+	for rawurl, allowed := range map[string]bool{
+		"https://www.example.com/page":              true,
+		"http://www.example.com/page":               false,
+		"https://admin.example.com/":                false,
+		"https://example.org/":                      false,
+		"http://intranet:8080/reports/q1":           true,
+		"http://intranet/reports/q1":                false,
+		"http://intranet:8080/admin/":               false,
+		"https://www.example.com:444/page":          true,
+		"http://intranet:8080/reports/./q1":         true,
+		"http://intranet:8080/reports/../admin/":    false,
+		"http://intranet:8080/reports/%2e%2e/admin": false,
+		"http://intranet:8080/reports/%2E%2E/admin": false,
+		"http://intranet:8080/reports/q1/../../x":   false,
+	} {
+		e := p.check(rawurl)
+		if (e == nil) != allowed {
+			t.Errorf("Got check(%v) = %v, wanted allowed = %v", rawurl, e, allowed)
+		}
+		if e != nil && errorCode(e) != "policy_denied" {
+			t.Errorf("Got error code %v, wanted policy_denied", errorCode(e))
+		}
+	}
+}
+
+func TestPolicyStoreReloadsChangedFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "getxpath")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policies.json")
+
+	ioutil.WriteFile(path, []byte(`{"default": {"deny": [{"hosts": ["*"]}]}, "keys": {"team-a": {}}}`), 0644)
+	store := &policyStore{path: path}
+	if e := store.reloadIfChanged(); e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	if store.check("", "http://example.com/") == nil {
+		t.Errorf("Expected the default policy to deny")
+	}
+	if e := store.check("team-a", "http://example.com/"); e != nil {
+		t.Errorf("Expected the key's policy to allow, got %v", e)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"default": {}}`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	store.reloadIfChanged()
+	if e := store.check("", "http://example.com/"); e != nil {
+		t.Errorf("Expected the reloaded default policy to allow, got %v", e)
+	}
+}
+
+func TestRequestHandlerRefusesDeniedURL(t *testing.T) {
+	defer func(file policyFile) { policies.file = file }(policies.file)
+	policies.file = policyFile{Default: &policy{Deny: []policyRule{{Hosts: []string{"example.com"}}}}}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/get?url=http://example.com/&xpath=//title", nil)
+	requestHandler(recorder, req)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Got status %d, wanted 403", recorder.Code)
+	}
+}
+
+func TestRequestHandlerRefusesRedirectToDeniedURL(t *testing.T) {
+	defer allowLoopback()()
+	adminHit := false
+	mux := http.NewServeMux()
+	mux.Handle("/start", http.RedirectHandler("/admin", http.StatusFound))
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		adminHit = true
+		w.Write([]byte(testPage))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	defer func(file policyFile) { policies.file = file }(policies.file)
+	policies.file = policyFile{Default: &policy{Allow: []policyRule{{PathPrefixes: []string{"/start"}}}}}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/get?xpath=//title&url="+server.URL+"/start", nil)
+	requestHandler(recorder, req)
+
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "policy_denied") {
+		t.Errorf("Got status %d and %s, wanted 403 and policy_denied", recorder.Code, recorder.Body.String())
+	}
+	if adminHit {
+		t.Errorf("Expected the denied redirect target not to be fetched")
+	}
+}
+
+func TestLogRequestRedactsCredentials(t *testing.T) {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stdout)
+
+	req := httptest.NewRequest("GET", "/get?api_key=s3cr3t&url=http://example.com&xpath=//title", nil)
+	req.Header.Set("X-API-Key", "h34d3r")
+	logRequest(req)
+
+	line := buf.String()
+	if strings.Contains(line, "s3cr3t") || strings.Contains(line, "h34d3r") || !strings.Contains(line, "GET /get?api_key=REDACTED&url=") {
+		t.Errorf("Got log line %s", line)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedHosts bounds the number of idle hosts the limiter remembers.
+const maxTrackedHosts = 1024
+
+// hostLimitsReloadInterval is how often the host limits file is checked for
+// changes.
+const hostLimitsReloadInterval = 5 * time.Second
+
+var hosts = newHostLimiter(hostLimit{Rate: 5, Burst: 5, Concurrency: 4})
+
+var httpClient = &http.Client{
+	Transport: newGuardedTransport(guard),
+	Timeout:   30 * time.Second,
+}
+
+// hostLimit is the politeness applied to outbound fetches to one host.
+type hostLimit struct {
+	// Rate is the sustained number of requests per second, 0 for no limit.
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests that may be sent at once after idling.
+	Burst int `json:"burst"`
+	// Concurrency is the maximum number of open requests, 0 for no limit.
+	Concurrency int `json:"concurrency"`
+}
+
+// hostLimiter queues outbound requests per host with a token bucket and a
+// cap on concurrent connections. Overrides apply to a domain and all of its
+// subdomains, the most specific domain winning.
+type hostLimiter struct {
+	mu        sync.Mutex
+	defaults  hostLimit
+	overrides map[string]hostLimit
+	hosts     map[string]*hostState
+	// crawlDelays are the Crawl-delays of the hosts' robots.txt, kept apart
+	// from their states so that they survive reloading the overrides.
+	crawlDelays map[string]time.Duration
+	// overridesModTime is the modification time of the overrides file
+	// last loaded.
+	overridesModTime time.Time
+}
+
+type hostState struct {
+	limit  hostLimit
+	slots  chan struct{}
+	tokens float64
+	last   time.Time
+	// users counts the requests waiting for or holding a slot. A state is
+	// only forgotten or replaced without users, so that they all share the
+	// same slots.
+	users int
+	// stale states are replaced once idle, as the overrides changed.
+	stale bool
+}
+
+func newHostLimiter(defaults hostLimit) *hostLimiter {
+	return &hostLimiter{
+		defaults:    defaults,
+		overrides:   make(map[string]hostLimit),
+		hosts:       make(map[string]*hostState),
+		crawlDelays: make(map[string]time.Duration),
+	}
+}
+
+// watchOverrides loads the overrides from path and keeps reloading them in
+// the background whenever the file's modification time changes.
+func (l *hostLimiter) watchOverrides(path string) error {
+	if e := l.reloadOverridesIfChanged(path); e != nil {
+		return e
+	}
+	go func() {
+		for range time.Tick(hostLimitsReloadInterval) {
+			if e := l.reloadOverridesIfChanged(path); e != nil {
+				logger.Printf("ERROR: Could not reload host limits from %s, keeping the previous ones: %v", path, e)
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *hostLimiter) reloadOverridesIfChanged(path string) error {
+	info, e := os.Stat(path)
+	if e != nil {
+		return e
+	}
+	l.mu.Lock()
+	unchanged := info.ModTime().Equal(l.overridesModTime)
+	l.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	if e := l.loadOverrides(path); e != nil {
+		return e
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overridesModTime = info.ModTime()
+	logger.Printf("Loaded host limits for %d domains from %s", len(l.overrides), path)
+	return nil
+}
+
+// loadOverrides reads per-domain limits from a JSON file mapping domain
+// names to limits, e.g. {"example.com": {"rate": 1, "burst": 1, "concurrency": 1}}.
+func (l *hostLimiter) loadOverrides(path string) error {
+	bytes, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	overrides := make(map[string]hostLimit)
+	if e := json.Unmarshal(bytes, &overrides); e != nil {
+		return e
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides = make(map[string]hostLimit)
+	for domain, limit := range overrides {
+		l.overrides[strings.ToLower(domain)] = limit
+	}
+	for host, s := range l.hosts {
+		if s.users == 0 {
+			delete(l.hosts, host)
+		} else {
+			s.stale = true
+		}
+	}
+	return nil
+}
+
+func (l *hostLimiter) limitFor(host string) hostLimit {
+	for domain := host; domain != ""; {
+		if limit, ok := l.overrides[domain]; ok {
+			return limit
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return l.defaults
+}
+
+// acquire returns the state of host, counting the caller as one of its
+// users until it calls done.
+func (l *hostLimiter) acquire(host string) (s *hostState, done func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.hosts[host]
+	if !ok || s.stale && s.users == 0 {
+		if len(l.hosts) >= maxTrackedHosts {
+			l.forgetIdleHosts()
+		}
+		limit := l.limitFor(host)
+		if delay, ok := l.crawlDelays[host]; ok {
+			limit = withCrawlDelay(limit, delay)
+		}
+		s = &hostState{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+		if limit.Concurrency > 0 {
+			s.slots = make(chan struct{}, limit.Concurrency)
+		}
+		l.hosts[host] = s
+	}
+	s.users++
+	return s, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		s.users--
+	}
+}
+
+// setCrawlDelay slows down requests to host to at most one per delay, as
+// asked for by the Crawl-delay of its robots.txt.
+func (l *hostLimiter) setCrawlDelay(host string, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.crawlDelays[host]; !ok && len(l.crawlDelays) >= maxTrackedHosts {
+		for tracked := range l.crawlDelays {
+			if _, ok := l.hosts[tracked]; !ok {
+				delete(l.crawlDelays, tracked)
+			}
+		}
+	}
+	l.crawlDelays[host] = delay
+	if s, ok := l.hosts[host]; ok {
+		s.limit = withCrawlDelay(s.limit, delay)
+		s.tokens = math.Min(s.tokens, float64(s.limit.Burst))
+	}
+}
+
+// withCrawlDelay lowers the rate of limit to one request per delay.
+func withCrawlDelay(limit hostLimit, delay time.Duration) hostLimit {
+	if rate := 1 / delay.Seconds(); limit.Rate <= 0 || rate < limit.Rate {
+		limit.Rate = rate
+		limit.Burst = 1
+	}
+	return limit
+}
+
+// forgetIdleHosts drops the states without users whose token bucket is
+// full again. The caller must hold l.mu.
+func (l *hostLimiter) forgetIdleHosts() {
+	now := time.Now()
+	for host, s := range l.hosts {
+		refilled := s.tokens+now.Sub(s.last).Seconds()*s.limit.Rate >= float64(s.limit.Burst)
+		if s.users == 0 && (refilled || s.limit.Rate <= 0) {
+			delete(l.hosts, host)
+		}
+	}
+}
+
+type noHostSlotKey struct{}
+
+// withoutHostSlot exempts the requests of ctx from the concurrency limit of
+// their host, keeping its rate limit.
+func withoutHostSlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noHostSlotKey{}, true)
+}
+
+// wait blocks until a request to host may be sent. It returns a function
+// to call when the request is done, and how long the request was queued.
+func (l *hostLimiter) wait(ctx context.Context, host string) (func(), time.Duration, error) {
+	start := time.Now()
+	s, done := l.acquire(host)
+
+	release := done
+	if s.slots != nil && ctx.Value(noHostSlotKey{}) == nil {
+		select {
+		case s.slots <- struct{}{}:
+			release = func() {
+				<-s.slots
+				done()
+			}
+		case <-ctx.Done():
+			done()
+			return nil, time.Since(start), ctx.Err()
+		}
+	}
+
+	if delay := l.reserve(s); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, time.Since(start), ctx.Err()
+		}
+	}
+	return release, time.Since(start), nil
+}
+
+// reserve takes a token from the bucket of s, going into debt when it is
+// empty, and returns how long the caller has to wait for its token.
+func (l *hostLimiter) reserve(s *hostState) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.limit.Rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	burst := math.Max(1, float64(s.limit.Burst))
+	s.tokens = math.Min(burst, s.tokens+now.Sub(s.last).Seconds()*s.limit.Rate)
+	s.last = now
+	s.tokens--
+	if s.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-s.tokens / s.limit.Rate * float64(time.Second))
+}
+
+// politeTransport applies the host limiter to every outbound request,
+// including retries and redirects, and adds the time spent queueing to the
+// queueWait accumulator found in the request context.
+type politeTransport struct {
+	limiter *hostLimiter
+	next    http.RoundTripper
+}
+
+type queueWaitKey struct{}
+
+func withQueueWait(ctx context.Context, total *int64) context.Context {
+	return context.WithValue(ctx, queueWaitKey{}, total)
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+
+	release, waited, e := t.limiter.wait(req.Context(), host)
+	if total, ok := req.Context().Value(queueWaitKey{}).(*int64); ok {
+		atomic.AddInt64(total, int64(waited))
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	resp, e := t.next.RoundTrip(req)
+	if e != nil {
+		release()
+		return nil, e
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody frees the connection slot of its host once closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	e := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return e
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterRateQueuesRequests(t *testing.T) {
+	limiter := newHostLimiter(hostLimit{Rate: 20, Burst: 1})
+
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		release, waited, e := limiter.wait(context.Background(), "example.com")
+		if e != nil {
+			t.Fatalf("Did not expect an eror but got: %v", e)
+		}
+		release()
+		waits = append(waits, waited)
+	}
+
+	if waits[0] > 10*time.Millisecond {
+		t.Errorf("Expected the first request not to wait, waited %v", waits[0])
+	}
+	if waits[2] < 30*time.Millisecond {
+		t.Errorf("Expected the third request to be queued, waited %v", waits[2])
+	}
+}
+
+func TestHostLimiterConcurrencyCap(t *testing.T) {
+	limiter := newHostLimiter(hostLimit{Concurrency: 1})
+
+	release, _, _ := limiter.wait(context.Background(), "example.com")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, e := limiter.wait(ctx, "example.com"); e == nil {
+		t.Errorf("Expected the second request to wait for the first one")
+	}
+	if other, _, e := limiter.wait(context.Background(), "example.org"); e != nil {
+		t.Errorf("Expected other hosts not to be affected, got: %v", e)
+	} else {
+		other()
+	}
+
+	release()
+	if again, _, e := limiter.wait(context.Background(), "example.com"); e != nil {
+		t.Errorf("Expected a free slot after release, got: %v", e)
+	} else {
+		again()
+	}
+}
+
+func TestHostLimiterOverridesApplyToSubdomains(t *testing.T) {
+	limiter := newHostLimiter(hostLimit{Rate: 5})
+	limiter.overrides["example.com"] = hostLimit{Rate: 1}
+	limiter.overrides["api.example.com"] = hostLimit{Rate: 2}
+
+	for host, expected := range map[string]float64{
+		"example.com":     1,
+		"www.example.com": 1,
+		"api.example.com": 2,
+		"example.org":     5,
+		"notexample.com":  5,
+	} {
+		if rate := limiter.limitFor(host).Rate; rate != expected {
+			t.Errorf("Got rate %v for %v, wanted %v", rate, host, expected)
+		}
+	}
+}
+
+func TestHostLimiterKeepsStatesInUse(t *testing.T) {
+	limiter := newHostLimiter(hostLimit{Concurrency: 1})
+
+	release, _, _ := limiter.wait(context.Background(), "example.com")
+	waited := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, _, e := limiter.wait(ctx, "example.com")
+		waited <- e
+	}()
+
+	limiter.mu.Lock()
+	limiter.forgetIdleHosts()
+	limiter.mu.Unlock()
+	if again, _, e := limiter.wait(ctx, "example.com"); e == nil {
+		again()
+		t.Errorf("Expected forgetting idle hosts to keep the busy host's slots")
+	}
+	if e := <-waited; e == nil {
+		t.Errorf("Expected the waiting request to still wait for the slot")
+	}
+	release()
+
+	limiter.mu.Lock()
+	limiter.forgetIdleHosts()
+	forgotten := len(limiter.hosts) == 0
+	limiter.mu.Unlock()
+	if !forgotten {
+		t.Errorf("Expected the idle host to be forgotten")
+	}
+}
+
+func TestHostLimiterOverridesKeepCrawlDelays(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "getxpath-limits")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.json")
+	ioutil.WriteFile(path, []byte(`{"example.org": {"rate": 1}}`), 0644)
+
+	limiter := newHostLimiter(hostLimit{Rate: 5, Burst: 5})
+	limiter.setCrawlDelay("example.com", 2*time.Second)
+	release, _, _ := limiter.wait(context.Background(), "example.com")
+	if e := limiter.loadOverrides(path); e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	release()
+
+	s, done := limiter.acquire("example.com")
+	defer done()
+	if s.limit.Rate != 0.5 || s.limit.Burst != 1 {
+		t.Errorf("Got limit %+v after reloading the overrides, wanted the crawl delay kept", s.limit)
+	}
+	if limiter.limitFor("example.org").Rate != 1 {
+		t.Errorf("Expected the override to be loaded")
+	}
+}
+
+func TestHostLimiterReloadsChangedOverrides(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "getxpath-limits")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.json")
+	ioutil.WriteFile(path, []byte(`{"example.com": {"rate": 1, "burst": 1, "concurrency": 1}}`), 0644)
+
+	limiter := newHostLimiter(hostLimit{Rate: 5, Burst: 5})
+	if e := limiter.reloadOverridesIfChanged(path); e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	release, _, _ := limiter.wait(context.Background(), "example.com")
+
+	ioutil.WriteFile(path, []byte(`{"example.com": {"rate": 2, "concurrency": 2}}`), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if e := limiter.reloadOverridesIfChanged(path); e != nil {
+		t.Fatalf("Did not expect an eror but got: %v", e)
+	}
+	// The request in flight keeps the state and its slot until it is done.
+	s, done := limiter.acquire("example.com")
+	if s.limit.Rate != 1 || !s.stale {
+		t.Errorf("Got limit %+v, wanted the busy state kept and marked stale", s.limit)
+	}
+	done()
+	release()
+
+	s, done = limiter.acquire("example.com")
+	defer done()
+	if s.limit.Rate != 2 || cap(s.slots) != 2 {
+		t.Errorf("Got limit %+v once idle, wanted the reloaded one", s.limit)
+	}
+
+	ioutil.WriteFile(path, []byte(`{`), 0644)
+	os.Chtimes(path, later, later)
+	if e := limiter.reloadOverridesIfChanged(path); e != nil {
+		t.Errorf("Expected an unchanged modification time to skip reloading, got %v", e)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// maxRedirects is the number of redirects followed per fetch, the same as
+// net/http does by default.
+const maxRedirects = 10
+
+// fetchChecks are the checks the URL of a query has to pass before it is
+// fetched. They are applied again to every redirect target.
+type fetchChecks struct {
+	// policy is the URL policy of the client's API key.
+	policy *policy
+	// robots refuses URLs disallowed by robots.txt.
+	robots bool
+}
+
+type fetchChecksKey struct{}
+
+func withFetchChecks(ctx context.Context, checks *fetchChecks) context.Context {
+	return context.WithValue(ctx, fetchChecksKey{}, checks)
+}
+
+func fetchChecksFrom(ctx context.Context) *fetchChecks {
+	checks, _ := ctx.Value(fetchChecksKey{}).(*fetchChecks)
+	return checks
+}
+
+// withRobotsCheck adds the robots.txt check to the fetch checks of ctx.
+func withRobotsCheck(ctx context.Context) context.Context {
+	checks := fetchChecks{robots: true}
+	if c := fetchChecksFrom(ctx); c != nil {
+		checks.policy = c.policy
+	}
+	return withFetchChecks(ctx, &checks)
+}
+
+func (c *fetchChecks) check(ctx context.Context, rawurl string) error {
+	if c == nil {
+		return nil
+	}
+	if e := c.policy.check(rawurl); e != nil {
+		return e
+	}
+	if c.robots {
+		return checkRobots(ctx, rawurl)
+	}
+	return nil
+}
+
+// key tells apart fetches which have to pass different checks, so that
+// they are not coalesced.
+func (c *fetchChecks) key() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%p %t", c.policy, c.robots)
+}
+
+// checkRedirect is installed here rather than in the declaration of
+// httpClient, as checking robots.txt fetches with httpClient itself.
+func init() {
+	httpClient.CheckRedirect = checkRedirect
+}
+
+type redirectsKey struct{}
+
+// withRedirects makes checkRedirect record the URLs redirected to in
+// redirects.
+func withRedirects(ctx context.Context, redirects *[]string) context.Context {
+	return context.WithValue(ctx, redirectsKey{}, redirects)
+}
+
+// checkRedirect is the CheckRedirect of httpClient. It refuses redirect
+// targets that fail the checks of the request context.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+	}
+	if redirects, ok := req.Context().Value(redirectsKey{}).(*[]string); ok {
+		*redirects = append(*redirects, req.URL.String())
+	}
+	return fetchChecksFrom(req.Context()).check(req.Context(), req.URL.String())
+}
+
+// checkRedirects applies the checks of ctx to the redirects a response
+// went through. Shared and cached responses may have been fetched for a
+// client with other checks.
+func checkRedirects(ctx context.Context, redirects []string) error {
+	checks := fetchChecksFrom(ctx)
+	for _, rawurl := range redirects {
+		if e := checks.check(ctx, rawurl); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestCheckRedirect(t *testing.T) {
+	p := &policy{Deny: []policyRule{{Hosts: []string{"internal.example.com"}}}}
+	var redirects []string
+	ctx := withRedirects(withFetchChecks(context.Background(), &fetchChecks{policy: p}), &redirects)
+	first, _ := http.NewRequest("GET", "http://example.com/", nil)
+	via := []*http.Request{first}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/page", nil)
+	if e := checkRedirect(req.WithContext(ctx), via); e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+	req, _ = http.NewRequest("GET", "http://internal.example.com/", nil)
+	if e := checkRedirect(req.WithContext(ctx), via); errorCode(e) != "policy_denied" {
+		t.Errorf("Got %v, wanted policy_denied", e)
+	}
+	if len(redirects) != 2 || redirects[0] != "http://www.example.com/page" {
+		t.Errorf("Got redirects %v", redirects)
+	}
+
+	for len(via) < maxRedirects {
+		via = append(via, first)
+	}
+	if e := checkRedirect(first, via); e == nil {
+		t.Errorf("Expected an error after %d redirects", maxRedirects)
+	}
+}
+
+func TestCheckRedirectsOfSharedResponses(t *testing.T) {
+	p := &policy{Allow: []policyRule{{Hosts: []string{"example.com"}}}}
+	ctx := withFetchChecks(context.Background(), &fetchChecks{policy: p})
+
+	if e := checkRedirects(ctx, []string{"http://example.com/next"}); e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+	if e := checkRedirects(ctx, []string{"http://example.com/next", "http://example.org/"}); errorCode(e) != "policy_denied" {
+		t.Errorf("Got %v, wanted policy_denied", e)
+	}
+	if e := checkRedirects(context.Background(), []string{"http://example.org/"}); e != nil {
+		t.Errorf("Expected no checks without fetch checks, got %v", e)
+	}
+}
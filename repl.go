@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moovweb/gokogiri/html"
+	"github.com/moovweb/gokogiri/xml"
+	"github.com/moovweb/gokogiri/xpath"
+)
+
+const replHelp = `Enter an XPath to evaluate it, or one of:
+  :reload              fetch and parse the document again
+  :output html|text    show matches as HTML or as their text
+  :limit N             show the first N matches
+  :set NAME VALUE      bind the XPath variable $NAME to VALUE, :set lists them
+  :save FILE           write all matches of the last XPath to FILE
+  :history             list the XPaths entered, !N repeats the Nth, !! the last
+  :help                show this help
+  :quit                leave
+`
+
+// replSession is a document fetched once and queried interactively.
+type replSession struct {
+	q     query
+	doc   *html.HtmlDocument
+	out   io.Writer
+	limit int
+	html  bool
+	vars  map[string]interface{}
+
+	history []string
+	// matches are all results of the last XPath, formatted for output.
+	matches []string
+}
+
+func runREPL(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("repl", stderr)
+	var c config
+	registerLocalSettings(fs, &c)
+	limit := fs.Int("limit", 5, "Number of matches shown per XPath")
+	output := fs.String("output", "text", "Show matches as html or text")
+	contentType := fs.String("content-type", "", "Media type and charset of the document, overriding detection")
+	vars := variablesFlag{}
+	fs.Var(vars, "var", "Bind the XPath variable $name, as in -var name=value (repeatable)")
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if fs.NArg() != 1 || fs.Arg(0) == stdinURL || *limit < 0 || (*output != "html" && *output != "text") {
+		fs.Usage()
+		return exitUsage
+	}
+	logger.SetOutput(stderr)
+	enableLocalFiles(false)
+
+	s := &replSession{
+		q:     withContentType(query{URL: fs.Arg(0)}, *contentType),
+		out:   stdout,
+		limit: *limit,
+		html:  *output == "html",
+		vars:  vars,
+	}
+	if e := s.load(false); e != nil {
+		fmt.Fprintf(stderr, "getxpath repl: %v\n", e)
+		return exitFailure
+	}
+	defer s.doc.Free()
+
+	fmt.Fprintf(stdout, "Type :help for help.\n")
+	s.run(stdin)
+	return exitOK
+}
+
+// load fetches and parses the document, revalidating a cached copy when
+// reloading.
+func (s *replSession) load(reload bool) error {
+	q := s.q
+	if reload {
+		q = withNoCache(q)
+	}
+	resp, _, e := fetchDocument(context.Background(), q)
+	if e != nil {
+		return e
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if q.Options != nil && q.Options.ContentType != "" {
+		contentType = q.Options.ContentType
+	}
+	utf8bytes, e := convertToUtf8(resp.Body, contentType)
+	if e != nil {
+		return e
+	}
+	doc, e := parseHtml(utf8bytes)
+	if e != nil {
+		return e
+	}
+
+	if s.doc != nil {
+		s.doc.Free()
+	}
+	s.doc = doc
+	fmt.Fprintf(s.out, "Loaded %s (%d bytes)\n", q.URL, len(resp.Body))
+	return nil
+}
+
+func withNoCache(q query) query {
+	options := queryOptions{}
+	if q.Options != nil {
+		options = *q.Options
+	}
+	options.NoCache = true
+	q.Options = &options
+	return q
+}
+
+func (s *replSession) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "xpath> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == ":quit" || line == ":q" {
+			return
+		}
+		s.handle(line)
+	}
+}
+
+func (s *replSession) handle(line string) {
+	if line == "" {
+		return
+	}
+	if strings.HasPrefix(line, "!") {
+		expr, e := s.fromHistory(line)
+		if e != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", e)
+			return
+		}
+		fmt.Fprintln(s.out, expr)
+		line = expr
+	}
+
+	command, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		command, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch command {
+	case ":help":
+		fmt.Fprint(s.out, replHelp)
+	case ":reload":
+		if e := s.load(true); e != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", e)
+		}
+	case ":output":
+		if arg != "html" && arg != "text" {
+			fmt.Fprintf(s.out, "Error: :output needs html or text\n")
+			return
+		}
+		s.html = arg == "html"
+	case ":limit":
+		n, e := strconv.Atoi(arg)
+		if e != nil || n < 0 {
+			fmt.Fprintf(s.out, "Error: :limit needs a non-negative number\n")
+			return
+		}
+		s.limit = n
+	case ":set":
+		s.set(arg)
+	case ":save":
+		s.save(arg)
+	case ":history":
+		for i, expr := range s.history {
+			fmt.Fprintf(s.out, "%3d  %s\n", i+1, expr)
+		}
+	default:
+		if strings.HasPrefix(command, ":") {
+			fmt.Fprintf(s.out, "Error: unknown command %s, see :help\n", command)
+			return
+		}
+		s.history = append(s.history, line)
+		s.eval(line)
+	}
+}
+
+func (s *replSession) fromHistory(line string) (string, error) {
+	if len(s.history) == 0 {
+		return "", fmt.Errorf("history is empty")
+	}
+	if line == "!!" {
+		return s.history[len(s.history)-1], nil
+	}
+	n, e := strconv.Atoi(line[1:])
+	if e != nil || n < 1 || n > len(s.history) {
+		return "", fmt.Errorf("no history entry %s", line[1:])
+	}
+	return s.history[n-1], nil
+}
+
+// eval prints the match count, time taken and the first matches with their
+// node paths, or the value of XPaths evaluating to a number, string or
+// boolean.
+func (s *replSession) eval(expr string) {
+	s.matches = nil
+	start := time.Now()
+	value, e := evalXpath(s.doc, expr, s.vars)
+	took := time.Since(start).Round(time.Microsecond)
+	if e != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", e)
+		return
+	}
+
+	nodes, ok := value.([]xml.Node)
+	if !ok {
+		s.matches = []string{fmt.Sprint(value)}
+		fmt.Fprintf(s.out, "%v (%T, %v)\n", value, value, took)
+		return
+	}
+	fmt.Fprintf(s.out, "%d matches (%v)\n", len(nodes), took)
+	for i, node := range nodes {
+		match := strings.TrimSpace(node.Content())
+		if s.html {
+			match = outerHTML(node)
+		}
+		s.matches = append(s.matches, match)
+		if i < s.limit {
+			fmt.Fprintf(s.out, "[%d] %s\n    %s\n", i+1, node.Path(), strings.Replace(match, "\n", "\n    ", -1))
+		}
+	}
+	if len(nodes) > s.limit {
+		fmt.Fprintf(s.out, "... %d more\n", len(nodes)-s.limit)
+	}
+}
+
+// evalXpath evaluates expr on doc like searchNodes, returning a node set,
+// or the number, string or boolean of XPaths not selecting nodes.
+func evalXpath(doc *html.HtmlDocument, expr string, vars map[string]interface{}) (interface{}, error) {
+	var value interface{}
+	e := evaluate(doc, expr, vars, func(x *compiledXpath) error {
+		ctx := doc.DocXPathCtx()
+		if e := ctx.Evaluate(doc.Root().NodePtr(), x.expr); e != nil {
+			return e
+		}
+		switch ctx.ReturnType() {
+		case xpath.XPATH_NODESET, xpath.XPATH_XSLT_TREE:
+			ptrs, e := ctx.ResultAsNodeset()
+			if e != nil {
+				return e
+			}
+			nodes := []xml.Node{}
+			for _, ptr := range ptrs {
+				nodes = append(nodes, xml.NewNode(ptr, doc))
+			}
+			value = nodes
+		case xpath.XPATH_NUMBER:
+			value, _ = ctx.ResultAsNumber()
+		case xpath.XPATH_BOOLEAN:
+			value, _ = ctx.ResultAsBoolean()
+		default:
+			value, _ = ctx.ResultAsString()
+		}
+		return nil
+	})
+	return value, e
+}
+
+// set binds a variable to the string value following its name, or lists
+// the bound variables without arguments.
+func (s *replSession) set(arg string) {
+	if arg == "" {
+		names := make([]string, 0, len(s.vars))
+		for name := range s.vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(s.out, "$%s = %v\n", name, s.vars[name])
+		}
+		return
+	}
+	name, value := arg, ""
+	if i := strings.IndexByte(arg, ' '); i > 0 {
+		name, value = arg[:i], strings.TrimSpace(arg[i+1:])
+	}
+	if !isVariableName(name) {
+		fmt.Fprintf(s.out, "Error: :set needs a variable name and a value\n")
+		return
+	}
+	if s.vars == nil {
+		s.vars = make(map[string]interface{})
+	}
+	s.vars[name] = value
+}
+
+func (s *replSession) save(path string) {
+	if path == "" {
+		fmt.Fprintf(s.out, "Error: :save needs a file name\n")
+		return
+	}
+	content := strings.Join(s.matches, "\n")
+	if len(s.matches) > 0 {
+		content += "\n"
+	}
+	if e := ioutil.WriteFile(path, []byte(content), 0644); e != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", e)
+		return
+	}
+	fmt.Fprintf(s.out, "Saved %d matches to %s\n", len(s.matches), path)
+}
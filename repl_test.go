@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const replTestPage = `<html><head><title>REPL</title></head><body>
+<ul><li class="item">One</li><li class="item">Two</li><li class="item">Three</li></ul>
+</body></html>`
+
+func runREPLSession(t *testing.T, input string) (int, string) {
+	defer saveSettings()()
+	defer func() { stdin = os.Stdin }()
+	dir, _ := ioutil.TempDir("", "getxpath-repl")
+	page := writeLocalPage(t, dir, "page.html", replTestPage)
+	stdin = strings.NewReader(input)
+
+	code, stdout, stderr := runTestCommand("repl", "-limit", "2", "file://"+page)
+	if stderr != "" {
+		t.Errorf("Got stderr '%s'", stderr)
+	}
+	return code, stdout
+}
+
+func TestREPLShowsMatchesWithPaths(t *testing.T) {
+	code, stdout := runREPLSession(t, "//li\ncount(//li)\n//li[\n")
+
+	if code != exitOK {
+		t.Errorf("Got exit code %d", code)
+	}
+	for _, expected := range []string{
+		"Loaded file://",
+		"3 matches",
+		"[1] /html/body/ul/li[1]\n    One",
+		"[2] /html/body/ul/li[2]\n    Two",
+		"... 1 more",
+		"3 (float64",
+		"Error: Invalid",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("Expected '%s' in '%s'", expected, stdout)
+		}
+	}
+}
+
+func TestREPLCommands(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "getxpath-repl-save")
+	saved := filepath.Join(dir, "matches.txt")
+
+	_, stdout := runREPLSession(t, ":output html\n//li[1]\n:output text\n!!\n:history\n:reload\n//li\n:save "+saved+"\n:frob\n:quit\n//never\n")
+
+	for _, expected := range []string{
+		`<li class="item">One</li>`,
+		"//li[1]\n1 matches",
+		"  1  //li[1]\n  2  //li[1]\n",
+		"Saved 3 matches",
+		"Error: unknown command :frob",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("Expected '%s' in '%s'", expected, stdout)
+		}
+	}
+	if strings.Contains(stdout, "//never") {
+		t.Errorf("Expected :quit to end the session")
+	}
+	if content, _ := ioutil.ReadFile(saved); string(content) != "One\nTwo\nThree\n" {
+		t.Errorf("Got saved matches '%s'", content)
+	}
+}
+
+func TestREPLVariables(t *testing.T) {
+	_, stdout := runREPLSession(t, "//li[. = $n]\n:set n Two\n:set\n//li[. = $n]\n//li[. = '$n']\ncount(//li[. != $n])\n:set 1$ x\n")
+
+	for _, expected := range []string{
+		"Error: XPath variable $n is not bound",
+		"$n = Two\n",
+		"1 matches",
+		"[1] /html/body/ul/li[2]\n    Two",
+		"0 matches",
+		"2 (float64",
+		"Error: :set needs a variable name and a value",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("Expected '%s' in '%s'", expected, stdout)
+		}
+	}
+}
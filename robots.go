@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robotsProductToken is the name getxpath looks for in robots.txt user-agent lines.
+const robotsProductToken = "getxpath"
+
+const (
+	robotsTTL      = 24 * time.Hour
+	robotsErrorTTL = 5 * time.Minute
+)
+
+// enforceRobots makes every query respect robots.txt, not only those asking for it.
+var enforceRobots = false
+
+var robots = &robotsCache{rules: make(map[string]*robotsRules)}
+
+// robotsRules is the group of a robots.txt that applies to getxpath.
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	expires    time.Time
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+var (
+	allowAll    = &robotsRules{}
+	disallowAll = &robotsRules{rules: []robotsRule{{allow: false, pattern: "/"}}}
+)
+
+// allowed reports whether path (including the query string) may be fetched.
+// The longest matching rule wins, Allow winning ties.
+func (r *robotsRules) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	allow, length := true, -1
+	for _, rule := range r.rules {
+		if !robotsPatternMatches(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > length || (len(rule.pattern) == length && rule.allow) {
+			allow, length = rule.allow, len(rule.pattern)
+		}
+	}
+	return allow
+}
+
+// robotsPatternMatches matches a path against a robots.txt path pattern,
+// where * matches any sequence of characters and a trailing $ anchors the
+// pattern at the end of the path.
+func robotsPatternMatches(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !anchored || rest == ""
+	}
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	last := parts[len(parts)-1]
+	if anchored {
+		return strings.HasSuffix(rest, last)
+	}
+	return strings.Contains(rest, last)
+}
+
+// parseRobots extracts the rules for productToken from a robots.txt. Groups
+// naming the longest matching user agent win over less specific ones and
+// the * group is used when no group names the product.
+func parseRobots(body []byte, productToken string) *robotsRules {
+	productToken = strings.ToLower(productToken)
+	groups := make(map[string]*robotsRules)
+	var current []string
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch field {
+		case "user-agent":
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			agent := strings.ToLower(value)
+			current = append(current, agent)
+			if groups[agent] == nil {
+				groups[agent] = &robotsRules{}
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			for _, agent := range current {
+				groups[agent].rules = append(groups[agent].rules, robotsRule{allow: field == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			inAgents = false
+			seconds, e := strconv.ParseFloat(value, 64)
+			if e != nil || seconds < 0 {
+				continue
+			}
+			for _, agent := range current {
+				groups[agent].crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	var best *robotsRules
+	bestLength := 0
+	for agent, rules := range groups {
+		if agent != "*" && strings.Contains(productToken, agent) && len(agent) > bestLength {
+			best, bestLength = rules, len(agent)
+		}
+	}
+	if best == nil {
+		best = groups["*"]
+	}
+	if best == nil {
+		return &robotsRules{}
+	}
+	return best
+}
+
+// robotsCache keeps the parsed robots.txt of each scheme and host.
+type robotsCache struct {
+	mu    sync.Mutex
+	rules map[string]*robotsRules
+}
+
+func (c *robotsCache) rulesFor(ctx context.Context, u *url.URL) (*robotsRules, error) {
+	origin := u.Scheme + "://" + u.Host
+
+	c.mu.Lock()
+	rules, ok := c.rules[origin]
+	c.mu.Unlock()
+	if !ok || time.Now().After(rules.expires) {
+		var e error
+		if rules, e = fetchRobots(ctx, origin); e != nil {
+			return nil, e
+		}
+
+		c.mu.Lock()
+		if len(c.rules) >= maxTrackedHosts {
+			c.forgetExpired()
+		}
+		c.rules[origin] = rules
+		c.mu.Unlock()
+	}
+
+	if rules.crawlDelay > 0 {
+		hosts.setCrawlDelay(strings.ToLower(u.Hostname()), rules.crawlDelay)
+	}
+	return rules, nil
+}
+
+func (c *robotsCache) forgetExpired() {
+	now := time.Now()
+	for origin, rules := range c.rules {
+		if now.After(rules.expires) {
+			delete(c.rules, origin)
+		}
+	}
+}
+
+// fetchRobots fetches and parses the robots.txt of origin. A missing
+// robots.txt allows everything; one that cannot be fetched disallows
+// everything until it is fetched again after robotsErrorTTL. Failed fetches
+// are not retried right away, which would hold up the query for seconds.
+// A fetch cut short by the deadline or cancelation of ctx is an error and
+// not remembered, as it tells nothing about the host.
+func fetchRobots(ctx context.Context, origin string) (*robotsRules, error) {
+	v, e, _ := fetches.do(ctx, "robots.txt "+origin, func() (interface{}, error) {
+		robotsCtx, cancel := robotsContext(ctx)
+		defer cancel()
+		return readRobots(robotsCtx, origin)
+	})
+	if e != nil {
+		return nil, fmt.Errorf("Could not fetch %s/robots.txt: %v", origin, e)
+	}
+	return v.(*robotsRules), nil
+}
+
+// robotsContext bounds a robots.txt fetch by the deadline of ctx. It keeps
+// none of its values, as the fetch checks of a query do not apply to
+// robots.txt, and exempts the fetch from the concurrency limit of the host:
+// robots.txt is checked for redirect targets while the redirecting
+// response may still hold the host's last slot.
+func robotsContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	base := withoutHostSlot(context.Background())
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(base, deadline)
+	}
+	return context.WithCancel(base)
+}
+
+func readRobots(ctx context.Context, origin string) (*robotsRules, error) {
+	var rules robotsRules
+	resp, e := get(ctx, origin+"/robots.txt", http.Header{})
+	var body []byte
+	if e == nil {
+		body, e = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if e != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	switch {
+	case e != nil || resp.StatusCode >= 500:
+		rules = *disallowAll
+		rules.expires = time.Now().Add(robotsErrorTTL)
+	case resp.StatusCode >= 400:
+		rules = *allowAll
+		rules.expires = time.Now().Add(robotsTTL)
+	default:
+		rules = *parseRobots(body, robotsProductToken)
+		rules.expires = time.Now().Add(robotsTTL)
+	}
+	return &rules, nil
+}
+
+func checkRobots(ctx context.Context, rawurl string) error {
+	u, e := url.Parse(rawurl)
+	if e != nil {
+		return e
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	rules, e := robots.rulesFor(ctx, u)
+	if e != nil {
+		return e
+	}
+	if !rules.allowed(u.RequestURI()) {
+		return &queryError{
+			Code:    "robots_disallowed",
+			Message: fmt.Sprintf("Fetching %s is disallowed by robots.txt", rawurl),
+		}
+	}
+	return nil
+}
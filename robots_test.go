@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+User-agent: *
+Disallow: /
+
+User-agent: Googlebot
+User-agent: getxpath
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 2
+`
+
+func TestParseRobotsSelectsProductGroup(t *testing.T) {
+	rules := parseRobots([]byte(testRobots), robotsProductToken)
+	if rules.crawlDelay != 2*time.Second {
+		t.Errorf("Got crawl delay %v, wanted 2s", rules.crawlDelay)
+	}
+
+	for path, expected := range map[string]bool{
+		"/":                     true,
+		"/robots.txt":           true,
+		"/private":              false,
+		"/private/secret":       false,
+		"/private/public/page":  true,
+		"/docs/manual.pdf":      false,
+		"/docs/manual.pdf?x=1":  true,
+		"/public?next=/private": true,
+	} {
+		if actual := rules.allowed(path); actual != expected {
+			t.Errorf("Got allowed(%v) = %v, wanted %v", path, actual, expected)
+		}
+	}
+}
+
+func TestParseRobotsFallsBackToWildcardGroup(t *testing.T) {
+	rules := parseRobots([]byte(testRobots), "otherbot")
+	if rules.allowed("/anything") {
+		t.Errorf("Expected the * group to disallow everything")
+	}
+}
+
+func TestRobotsPatternMatches(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish*.php", "/fishheads/catfish.php?parameters", true},
+		{"/*.php$", "/filename.php", true},
+		{"/*.php$", "/filename.php?parameters", false},
+		{"/fish$", "/fish", true},
+		{"/fish$", "/fishes", false},
+		{"*", "/anything", true},
+	} {
+		if actual := robotsPatternMatches(c.pattern, c.path); actual != c.expected {
+			t.Errorf("Got robotsPatternMatches(%v, %v) = %v, wanted %v", c.pattern, c.path, actual, c.expected)
+		}
+	}
+}
+
+func TestRobotsDisallowedError(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprint(w, "User-agent: getxpath\nDisallow: /private\n")
+			return
+		}
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	options := &queryOptions{Robots: true}
+	_, _, e := extractQuery(context.Background(), query{URL: server.URL + "/private/page", Xpath: "//title", Options: options})
+	if errorCode(e) != "robots_disallowed" {
+		t.Errorf("Got error %v, wanted robots_disallowed", e)
+	}
+	if _, _, e := extractQuery(context.Background(), query{URL: server.URL + "/public", Xpath: "//title", Options: options}); e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+}
+
+func TestRobotsCheckedOnRedirects(t *testing.T) {
+	defer allowLoopback()()
+	privateHit := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: getxpath\nDisallow: /private\n")
+		case "/public":
+			http.Redirect(w, r, "/private/page", http.StatusFound)
+		default:
+			privateHit = true
+			fmt.Fprint(w, testPage)
+		}
+	}))
+	defer server.Close()
+
+	options := &queryOptions{Robots: true}
+	_, _, e := extractQuery(context.Background(), query{URL: server.URL + "/public", Xpath: "//title", Options: options})
+	if errorCode(e) != "robots_disallowed" {
+		t.Errorf("Got error %v, wanted robots_disallowed", e)
+	}
+	if privateHit {
+		t.Errorf("Expected the disallowed redirect target not to be fetched")
+	}
+}
+
+func TestRobotsFetchIsNotRetried(t *testing.T) {
+	defer allowLoopback()()
+	var fetches int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	rules, e := fetchRobots(context.Background(), server.URL)
+	if e != nil || rules.allowed("/page") {
+		t.Errorf("Expected a robots.txt that cannot be fetched to disallow everything")
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Errorf("Got %d fetches of robots.txt, wanted 1", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Fetching robots.txt took %v", elapsed)
+	}
+}
+
+// withHostConcurrency limits the requests to 127.0.0.1 to concurrency at
+// a time, without rate limit.
+func withHostConcurrency(concurrency int) func() {
+	hosts.mu.Lock()
+	defer hosts.mu.Unlock()
+	saved := hosts.overrides
+	hosts.overrides = map[string]hostLimit{"127.0.0.1": {Concurrency: concurrency}}
+	delete(hosts.hosts, "127.0.0.1")
+	return func() {
+		hosts.mu.Lock()
+		defer hosts.mu.Unlock()
+		hosts.overrides = saved
+		delete(hosts.hosts, "127.0.0.1")
+	}
+}
+
+func TestRobotsCheckedOnSameHostRedirectWithOneSlot(t *testing.T) {
+	defer allowLoopback()()
+	defer withHostConcurrency(1)()
+	// Both servers are on host 127.0.0.1 and share its one slot, but they
+	// are different origins with their own robots.txt, like http and https.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+			return
+		}
+		fmt.Fprint(w, testPage)
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, target.URL+"/page", http.StatusFound)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	options := &queryOptions{Robots: true}
+	res, _, e := extractQuery(ctx, query{URL: server.URL + "/start", Xpath: "//title", Options: options})
+	if e != nil || res != "Cached Page" {
+		t.Errorf("Got %q and %v after %v", res, e, time.Since(start))
+	}
+}
+
+func TestRobotsTimeoutIsNotCached(t *testing.T) {
+	defer allowLoopback()()
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	u, _ := url.Parse(server.URL + "/page")
+	if _, e := robots.rulesFor(ctx, u); e == nil {
+		t.Fatalf("Expected the robots.txt fetch to time out")
+	}
+	robots.mu.Lock()
+	_, cached := robots.rules[server.URL]
+	robots.mu.Unlock()
+	if cached {
+		t.Errorf("Expected a robots.txt fetch that timed out not to be remembered")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var serverSettings = struct {
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	maxHeaderBytes  int
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+}{
+	readTimeout:     10 * time.Second,
+	writeTimeout:    60 * time.Second,
+	idleTimeout:     120 * time.Second,
+	maxHeaderBytes:  64 << 10,
+	drainDelay:      0,
+	shutdownTimeout: 25 * time.Second,
+}
+
+// ready is 1 while the server accepts new work and 0 before it started and
+// once it is shutting down.
+var ready int32
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        handler,
+		ReadTimeout:    serverSettings.readTimeout,
+		WriteTimeout:   serverSettings.writeTimeout,
+		IdleTimeout:    serverSettings.idleTimeout,
+		MaxHeaderBytes: serverSettings.maxHeaderBytes,
+	}
+}
+
+// serve runs server on listener until it fails or a signal arrives on stop.
+// It then reports not ready, waits for the drain delay so load balancers
+// notice, and lets in-flight requests finish within the shutdown timeout.
+func serve(server *http.Server, listener net.Listener, stop <-chan os.Signal) error {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.Serve(listener)
+	}()
+	atomic.StoreInt32(&ready, 1)
+	logger.Printf("Listening on %s", listener.Addr())
+
+	select {
+	case e := <-failed:
+		atomic.StoreInt32(&ready, 0)
+		return e
+	case sig := <-stop:
+		logger.Printf("Received %v, shutting down", sig)
+	}
+
+	atomic.StoreInt32(&ready, 0)
+	time.Sleep(serverSettings.drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverSettings.shutdownTimeout)
+	defer cancel()
+	if e := server.Shutdown(ctx); e != nil {
+		return e
+	}
+	logger.Printf("Shut down cleanly")
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestServeFinishesInFlightRequestsOnShutdown(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		fmt.Fprint(w, "done")
+	})
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(newServer(handler), listener, stop) }()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, e := http.Get("http://" + listener.Addr().String())
+		if e != nil {
+			responses <- e.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	waitFor(t, func() bool { return !isReady() })
+	close(finish)
+
+	if body := <-responses; body != "done" {
+		t.Errorf("Got '%v', wanted the in-flight request to finish", body)
+	}
+	if e := <-served; e != nil {
+		t.Errorf("Did not expect an eror but got: %v", e)
+	}
+}
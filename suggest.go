@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	encxml "encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/moovweb/gokogiri/html"
+	"github.com/moovweb/gokogiri/xml"
+)
+
+const (
+	// maxSuggestTargets limits the matching nodes XPaths are proposed for.
+	maxSuggestTargets = 5
+	// maxSuggestions limits the number of XPaths proposed.
+	maxSuggestions = 10
+	// maxLabelLength is the longest text of a sibling used as anchor.
+	maxLabelLength = 40
+)
+
+// Base scores of the suggestion strategies, the more robust the higher.
+var strategyScores = map[string]int{
+	"id":         100,
+	"class":      80,
+	"text":       60,
+	"structural": 40,
+}
+
+type suggestion struct {
+	Xpath    string `json:"xpath" xml:"xpath"`
+	Strategy string `json:"strategy" xml:"strategy"`
+	// Matches is the number of nodes the XPath matches; extraction uses
+	// the first.
+	Matches int `json:"matches" xml:"matches"`
+	Score   int `json:"score" xml:"score"`
+}
+
+type suggestQuery struct {
+	URL  string `json:"url" xml:"url"`
+	Text string `json:"text" xml:"text"`
+}
+
+type suggestResult struct {
+	XMLName     encxml.Name  `json:"-" xml:"getxpath"`
+	Query       suggestQuery `json:"query" xml:"query"`
+	Suggestions []suggestion `json:"suggestions" xml:"suggestion"`
+	Error       interface{}  `json:"error" xml:"error,omitempty"`
+	ErrorCode   string       `json:"error_code,omitempty" xml:"error_code,omitempty"`
+}
+
+// text is one suggested XPath per line, or the error message.
+func (res suggestResult) text() string {
+	if res.Error != nil {
+		return fmt.Sprint(res.Error)
+	}
+	var text string
+	for _, s := range res.Suggestions {
+		text += s.Xpath + "\n"
+	}
+	return text
+}
+
+// suggestCSVHeader are the columns of CSV suggestions, one record per
+// suggestion or a single one for an error.
+var suggestCSVHeader = []string{"url", "text", "xpath", "strategy", "matches", "score", "error", "error_code"}
+
+func (res suggestResult) csv() ([]string, [][]string) {
+	if res.Error != nil || len(res.Suggestions) == 0 {
+		message := ""
+		if res.Error != nil {
+			message = fmt.Sprint(res.Error)
+		}
+		return suggestCSVHeader, [][]string{{res.Query.URL, res.Query.Text, "", "", "", "", message, res.ErrorCode}}
+	}
+	records := make([][]string, len(res.Suggestions))
+	for i, s := range res.Suggestions {
+		records[i] = []string{res.Query.URL, res.Query.Text, s.Xpath, s.Strategy, strconv.Itoa(s.Matches), strconv.Itoa(s.Score), "", ""}
+	}
+	return suggestCSVHeader, records
+}
+
+// suggestXpaths fetches the page at url and proposes XPaths extracting
+// text from it.
+func suggestXpaths(ctx context.Context, url string, text string) ([]suggestion, error) {
+	resp, _, e := fetchDocument(ctx, query{URL: url})
+	if e != nil {
+		return nil, e
+	}
+	atomic.AddInt64(&status.BytesProcessed, int64(len(resp.Body)))
+
+	d, e := documents.acquire(url, resp.Body, resp.Header.Get("Content-Type"))
+	if e != nil {
+		return nil, e
+	}
+	defer documents.release(d)
+
+	d.searchMu.Lock()
+	defer d.searchMu.Unlock()
+	return suggestForDocument(d.doc, text)
+}
+
+// suggestForDocument finds the innermost elements whose text is, or else
+// contains, text and proposes XPaths for them, ranked by robustness. Only
+// XPaths verified to extract the text are proposed.
+func suggestForDocument(doc *html.HtmlDocument, text string) ([]suggestion, error) {
+	want := normalizeSpace(text)
+	if want == "" {
+		return nil, fmt.Errorf("Need a text to look for.")
+	}
+
+	exact := true
+	targets, e := doc.Root().Search(innermostXpath("normalize-space(.)=" + xpathLiteral(want)))
+	if e == nil && len(targets) == 0 {
+		exact = false
+		targets, e = doc.Root().Search(innermostXpath("contains(normalize-space(.), " + xpathLiteral(want) + ")"))
+	}
+	if e != nil {
+		return nil, e
+	}
+	if len(targets) == 0 {
+		return nil, &queryError{Code: "text_not_found", Message: fmt.Sprintf("'%s' was not found on the page.", want)}
+	}
+	if len(targets) > maxSuggestTargets {
+		targets = targets[:maxSuggestTargets]
+	}
+
+	var suggestions []suggestion
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		for _, s := range candidateXpaths(target) {
+			if seen[s.Xpath] {
+				continue
+			}
+			seen[s.Xpath] = true
+
+			nodes, e := doc.Root().Search(s.Xpath)
+			if e != nil || len(nodes) == 0 {
+				continue
+			}
+			got := normalizeSpace(nodes[0].Content())
+			if exact && got != want || !exact && !strings.Contains(got, want) {
+				continue
+			}
+			s.Matches = len(nodes)
+			if s.Matches > 1 {
+				s.Score -= 10
+			}
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return len(suggestions[i].Xpath) < len(suggestions[j].Xpath)
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions, nil
+}
+
+// innermostXpath selects the elements satisfying condition none of whose
+// children do.
+func innermostXpath(condition string) string {
+	return fmt.Sprintf("//body//*[not(self::script or self::style)][%s][not(*[%s])]", condition, condition)
+}
+
+// candidateXpaths proposes id, class, text-anchored and structural XPaths
+// for node.
+func candidateXpaths(node xml.Node) []suggestion {
+	candidate := func(strategy string, xpath string, penalty int) suggestion {
+		return suggestion{Xpath: xpath, Strategy: strategy, Score: strategyScores[strategy] - penalty}
+	}
+	var candidates []suggestion
+
+	// The node's or the nearest ancestor's id, each step below costing
+	// some robustness.
+	for n, depth := node, 0; n != nil && n.NodeType() == xml.XML_ELEMENT_NODE; n, depth = n.Parent(), depth+1 {
+		if id := n.Attr("id"); id != "" {
+			xpath := fmt.Sprintf("//%s[@id=%s]%s", elementName(n), xpathLiteral(id), relativePath(n, node))
+			candidates = append(candidates, candidate("id", xpath, 10*depth))
+			break
+		}
+	}
+
+	for _, class := range strings.Fields(node.Attr("class")) {
+		xpath := fmt.Sprintf(`//%s[contains(concat(" ", normalize-space(@class), " "), %s)]`, elementName(node), xpathLiteral(" "+class+" "))
+		candidates = append(candidates, candidate("class", xpath, 0))
+	}
+
+	// A label in front of the node or one of its parents, as in
+	// <dt>Price</dt><dd>9.99</dd>.
+	for n, depth := node, 0; n != nil && depth < 3 && n.NodeType() == xml.XML_ELEMENT_NODE; n, depth = n.Parent(), depth+1 {
+		label := previousElement(n)
+		if label == nil {
+			continue
+		}
+		text := normalizeSpace(label.Content())
+		if text == "" || len(text) > maxLabelLength {
+			continue
+		}
+		xpath := fmt.Sprintf("//%s[normalize-space(.)=%s]/following-sibling::%s[1]%s",
+			elementName(label), xpathLiteral(text), elementName(n), relativePath(n, node))
+		candidates = append(candidates, candidate("text", xpath, 10*depth))
+		break
+	}
+
+	candidates = append(candidates, candidate("structural", node.Path(), 0))
+	return candidates
+}
+
+// relativePath returns the location path from ancestor down to node, with
+// positions where siblings share the name.
+func relativePath(ancestor xml.Node, node xml.Node) string {
+	var steps []string
+	for n := node; n != nil && n.NodePtr() != ancestor.NodePtr(); n = n.Parent() {
+		step := "/" + elementName(n)
+		if position, count := siblingPosition(n); count > 1 {
+			step += fmt.Sprintf("[%d]", position)
+		}
+		steps = append([]string{step}, steps...)
+	}
+	return strings.Join(steps, "")
+}
+
+func siblingPosition(node xml.Node) (int, int) {
+	parent := node.Parent()
+	if parent == nil {
+		return 1, 1
+	}
+	position, count := 0, 0
+	for child := parent.FirstChild(); child != nil; child = child.NextSibling() {
+		if child.NodeType() == xml.XML_ELEMENT_NODE && child.Name() == node.Name() {
+			count++
+			if child.NodePtr() == node.NodePtr() {
+				position = count
+			}
+		}
+	}
+	return position, count
+}
+
+func previousElement(node xml.Node) xml.Node {
+	for n := node.PreviousSibling(); n != nil; n = n.PreviousSibling() {
+		if n.NodeType() == xml.XML_ELEMENT_NODE {
+			return n
+		}
+	}
+	return nil
+}
+
+func elementName(node xml.Node) string {
+	return strings.ToLower(node.Name())
+}
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// xpathLiteral quotes s as an XPath string literal. XPath has no escapes,
+// so strings with both kinds of quotes are concatenated.
+func xpathLiteral(s string) string {
+	if !strings.Contains(s, `"`) {
+		return `"` + s + `"`
+	}
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'"
+	}
+	parts := strings.Split(s, `"`)
+	for i, part := range parts {
+		parts[i] = `"` + part + `"`
+	}
+	return "concat(" + strings.Join(parts, `, '"', `) + ")"
+}
+
+// suggestHandler answers /suggest?url=...&text=... with XPaths extracting
+// the text from the page.
+func suggestHandler(writer http.ResponseWriter, req *http.Request) {
+	startRequest(req)
+	format, formatErr := negotiateFormat(req)
+
+	values := req.URL.Query()
+	res := suggestResult{Query: suggestQuery{URL: values.Get("url"), Text: values.Get("text")}}
+	code := http.StatusOK
+	p := policies.policyFor(apiKey(req))
+	if formatErr != nil {
+		code = http.StatusBadRequest
+		res.Error = formatErr.Error()
+	} else if res.Query.URL == "" || res.Query.Text == "" {
+		code = http.StatusBadRequest
+		res.Error = "Need both url and text query parameter."
+	} else if e := p.check(res.Query.URL); e != nil {
+		code = http.StatusForbidden
+		res.Error = e.Error()
+		res.ErrorCode = errorCode(e)
+	} else {
+		ctx := withFetchChecks(req.Context(), &fetchChecks{policy: p})
+		suggestions, e := suggestXpaths(ctx, res.Query.URL, res.Query.Text)
+		res.Suggestions = suggestions
+		res.Error = errorMessageOrNil(e)
+		res.ErrorCode = errorCode(e)
+		switch res.ErrorCode {
+		case "policy_denied":
+			code = http.StatusForbidden
+		case "text_not_found":
+			code = http.StatusNotFound
+		}
+		if e != nil {
+			logger.Printf("ERROR: Could not suggest xpaths for %v because: %v", res.Query, e)
+		}
+	}
+
+	countResult(res.Error != nil)
+	writeResult(writer, format, code, res)
+}
+
+func runSuggest(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("suggest", stderr)
+	var c config
+	registerLocalSettings(fs, &c)
+	output := fs.String("output", "table", "Output format: table or json")
+	if code, ok := parseFlags(fs, &c, args, stderr); !ok {
+		return code
+	}
+	if fs.NArg() != 2 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+	logger.SetOutput(stderr)
+	enableLocalFiles(true)
+
+	suggestions, e := suggestXpaths(context.Background(), fs.Arg(0), fs.Arg(1))
+	if *output == "json" {
+		res := suggestResult{
+			Query:       suggestQuery{URL: fs.Arg(0), Text: fs.Arg(1)},
+			Suggestions: suggestions,
+			Error:       errorMessageOrNil(e),
+			ErrorCode:   errorCode(e),
+		}
+		json.NewEncoder(stdout).Encode(res)
+	} else {
+		for _, s := range suggestions {
+			fmt.Fprintf(stdout, "%5d  %-10s  %3d  %s\n", s.Score, s.Strategy, s.Matches, s.Xpath)
+		}
+	}
+	if e != nil {
+		fmt.Fprintf(stderr, "getxpath suggest: %v\n", e)
+		return exitFailure
+	}
+	if len(suggestions) == 0 {
+		fmt.Fprintf(stderr, "getxpath suggest: no XPath found that extracts the text\n")
+		return exitFailure
+	}
+	return exitOK
+}
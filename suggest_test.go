@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const suggestTestPage = `<html><body>
+<div id="product">
+  <h1 class="title">Espresso Machine</h1>
+  <dl><dt>Price</dt><dd><span class="amount">  249.00 EUR </span></dd><dt>Stock</dt><dd>12</dd></dl>
+</div>
+<ul><li>He said "don't"</li></ul>
+</body></html>`
+
+func suggestionsFor(t *testing.T, text string) []suggestion {
+	doc, e := parseHtml([]byte(suggestTestPage))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+	suggestions, e := suggestForDocument(doc, text)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return suggestions
+}
+
+func TestSuggestRanksByRobustness(t *testing.T) {
+	suggestions := suggestionsFor(t, "249.00 EUR")
+
+	var xpaths []string
+	for _, s := range suggestions {
+		xpaths = append(xpaths, s.Strategy+" "+s.Xpath)
+	}
+	expected := []string{
+		`class //span[contains(concat(" ", normalize-space(@class), " "), " amount ")]`,
+		`id //div[@id="product"]/dl/dd[1]/span`,
+		`text //dt[normalize-space(.)="Price"]/following-sibling::dd[1]/span`,
+		`structural /html/body/div/dl/dd[1]/span`,
+	}
+	if strings.Join(xpaths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got\n%s\nwanted\n%s", strings.Join(xpaths, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestSuggestVerifiesCandidates(t *testing.T) {
+	for _, s := range suggestionsFor(t, "12") {
+		// The first dd holds the price, so //dl/dd would extract the wrong text.
+		if s.Xpath == "//div[@id=\"product\"]/dl/dd" {
+			t.Errorf("Got unverified suggestion %v", s)
+		}
+		if s.Strategy == "text" && s.Xpath != `//dt[normalize-space(.)="Stock"]/following-sibling::dd[1]` {
+			t.Errorf("Got %v", s)
+		}
+	}
+}
+
+func TestSuggestQuotesLiterals(t *testing.T) {
+	suggestions := suggestionsFor(t, `He said "don't"`)
+	if len(suggestions) == 0 {
+		t.Fatal("Expected suggestions")
+	}
+	if literal := xpathLiteral(`He said "don't"`); literal != `concat("He said ", '"', "don't", '"', "")` {
+		t.Errorf("Got %s", literal)
+	}
+}
+
+func TestSuggestTextNotFound(t *testing.T) {
+	doc, _ := parseHtml([]byte(suggestTestPage))
+	defer doc.Free()
+	if _, e := suggestForDocument(doc, "Teapot"); errorCode(e) != "text_not_found" {
+		t.Errorf("Got %v", e)
+	}
+}
+
+func TestSuggestHandler(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, suggestTestPage)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", "/suggest?url="+server.URL+"&text=Espresso+Machine", nil)
+	recorder := httptest.NewRecorder()
+	suggestHandler(recorder, req)
+
+	var res suggestResult
+	if e := json.Unmarshal(recorder.Body.Bytes(), &res); e != nil {
+		t.Fatal(e)
+	}
+	if recorder.Code != 200 || len(res.Suggestions) == 0 || res.Suggestions[0].Strategy != "id" {
+		t.Errorf("Got %d and %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSuggestHandlerFormatsAndStatus(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, suggestTestPage)
+	}))
+	defer server.Close()
+
+	errors := status.ErrorCount
+	req, _ := http.NewRequest("GET", "/suggest?url="+server.URL+"&text=Teapot", nil)
+	recorder := httptest.NewRecorder()
+	suggestHandler(recorder, req)
+	if recorder.Code != 404 || !strings.Contains(recorder.Body.String(), "text_not_found") {
+		t.Errorf("Got %d and %s", recorder.Code, recorder.Body.String())
+	}
+	if status.ErrorCount != errors+1 {
+		t.Errorf("Expected the error to be counted")
+	}
+
+	req, _ = http.NewRequest("GET", "/suggest?url="+server.URL+"&text=Espresso+Machine&format=csv", nil)
+	recorder = httptest.NewRecorder()
+	suggestHandler(recorder, req)
+	lines := strings.Split(recorder.Body.String(), "\n")
+	if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "text/csv; charset=utf-8" ||
+		lines[0] != "url,text,xpath,strategy,matches,score,error,error_code" || !strings.HasSuffix(lines[1], `"//div[@id=""product""]/h1",id,1,90,,`) {
+		t.Errorf("Got %d and %s", recorder.Code, recorder.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/suggest?url="+server.URL+"&text=Espresso+Machine&format=yaml", nil)
+	recorder = httptest.NewRecorder()
+	suggestHandler(recorder, req)
+	if recorder.Code != 400 {
+		t.Errorf("Got %d, wanted 400 for an unknown format", recorder.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseTOMLSettings reads settings from the subset of TOML config files
+// need: one key = value pair per line with string, number, boolean or
+// array values, and # comments. Tables and multi-line values are not
+// supported. Arrays are joined into comma separated lists.
+func parseTOMLSettings(text string) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(text, "\n") {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fail("tables are not supported")
+		}
+
+		name, rest, e := tomlKey(line)
+		if e != nil {
+			return nil, fail("%v", e)
+		}
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fail("expected = after %s", name)
+		}
+		if _, ok := values[name]; ok {
+			return nil, fail("%s is set twice", name)
+		}
+		value, rest, e := tomlValue(strings.TrimSpace(rest[1:]), true)
+		if e != nil {
+			return nil, fail("%v", e)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, fail("unexpected %q after the value of %s", rest, name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// tomlKey reads a bare or quoted key off the start of s.
+func tomlKey(s string) (string, string, error) {
+	if s[0] == '"' || s[0] == '\'' {
+		return tomlString(s)
+	}
+	end := 0
+	for end < len(s) && (s[end] == '-' || s[end] == '_' || s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+		end++
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("expected a key")
+	}
+	return s[:end], s[end:], nil
+}
+
+// tomlValue reads a value off the start of s and returns it as the string
+// given to the setting's flag.
+func tomlValue(s string, arrays bool) (string, string, error) {
+	switch {
+	case s == "":
+		return "", "", fmt.Errorf("expected a value")
+	case s[0] == '"' || s[0] == '\'':
+		return tomlString(s)
+	case s[0] == '[' && arrays:
+		var items []string
+		rest := strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			item, r, e := tomlValue(rest, false)
+			if e != nil {
+				return "", "", e
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+		return strings.Join(items, ","), rest[1:], nil
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	word := s[:end]
+	if word == "true" || word == "false" {
+		return word, s[end:], nil
+	}
+	number := strings.Replace(word, "_", "", -1)
+	if _, e := strconv.ParseFloat(number, 64); e != nil {
+		return "", "", fmt.Errorf("invalid value %q, strings need quotes", word)
+	}
+	return number, s[end:], nil
+}
+
+// tomlString reads a basic "..." or literal '...' string off the start of s.
+func tomlString(s string) (string, string, error) {
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, e := strconv.Unquote(s[:i+1])
+			if e != nil {
+				return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return value, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// writeTOMLSettings writes settings as TOML, sorted by name. Strings are
+// quoted, numbers and booleans are not.
+func writeTOMLSettings(w io.Writer, values map[string]interface{}) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = strconv.QuoteToASCII(v)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if _, e := fmt.Fprintf(w, "%s = %s\n", name, value); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLSettings(t *testing.T) {
+	values, e := parseTOMLSettings(`
+# Comments and blank lines are skipped.
+port = 8_080 # trailing comment
+"fetch-timeout" = "20s"
+ssrf-protection = false
+allow-hosts = [ "a.example.com", "b.example.com", ]
+file-root = 'C:\pages'
+deny-hosts = []
+`)
+	expected := map[string]string{
+		"port":            "8080",
+		"fetch-timeout":   "20s",
+		"ssrf-protection": "false",
+		"allow-hosts":     "a.example.com,b.example.com",
+		"file-root":       `C:\pages`,
+		"deny-hosts":      "",
+	}
+	if e != nil || !reflect.DeepEqual(values, expected) {
+		t.Errorf("Got %v, %v", values, e)
+	}
+}
+
+func TestParseTOMLSettingsErrors(t *testing.T) {
+	for text, message := range map[string]string{
+		"[server]\nport = 1":    "line 1: tables are not supported",
+		"port = 1\nport = 2":    "line 2: port is set twice",
+		"timezone = CET":        "strings need quotes",
+		"timezone = \"CET":      "unterminated string",
+		"port 8080":             "expected = after port",
+		"port = 1 2":            "unexpected",
+		"hosts = [\"a\" \"b\"]": "expected , or ]",
+	} {
+		if _, e := parseTOMLSettings(text); e == nil || !strings.Contains(e.Error(), message) {
+			t.Errorf("Got %v for %q, wanted %q", e, text, message)
+		}
+	}
+}
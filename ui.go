@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// uiAsset is a static file of the playground.
+type uiAsset struct {
+	contentType string
+	body        string
+}
+
+// uiAssets are served under /ui/, the page itself at /.
+var uiAssets = map[string]uiAsset{
+	"app.js":    {"application/javascript; charset=utf-8", uiScript},
+	"style.css": {"text/css; charset=utf-8", uiStyle},
+}
+
+// uiHandler serves the playground page at / and its assets under /ui/. The
+// page calls /get, so it needs no authentication itself.
+func uiHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	asset, ok := uiAsset{"text/html; charset=utf-8", uiPage}, true
+	if req.URL.Path != "/" {
+		asset, ok = uiAssets[strings.TrimPrefix(req.URL.Path, "/ui/")]
+	}
+	if !ok || req.URL.Path != "/" && !strings.HasPrefix(req.URL.Path, "/ui/") {
+		http.NotFound(writer, req)
+		return
+	}
+
+	writer.Header().Set("Content-Type", asset.contentType)
+	writer.Header().Set("Content-Security-Policy", "default-src 'self'")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Cache-Control", "no-cache")
+	if req.Method == "GET" {
+		writer.Write([]byte(asset.body))
+	}
+}
+
+const uiPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>getxpath playground</title>
+<link rel="stylesheet" href="/ui/style.css">
+</head>
+<body>
+<h1>getxpath</h1>
+<form id="query">
+  <label>URL <input id="url" type="url" required placeholder="https://example.com/"></label>
+  <label>
+    <select id="mode" aria-label="Expression type">
+      <option value="xpath">XPath</option>
+      <option value="css">CSS</option>
+    </select>
+    <input id="expr" required placeholder="//h1">
+  </label>
+  <label>API key <input id="key" type="password" autocomplete="off" placeholder="optional"></label>
+  <div class="actions">
+    <button type="submit">Extract</button>
+    <button type="button" id="copy">Copy as curl</button>
+    <span id="copied" hidden>Copied</span>
+  </div>
+</form>
+<section id="output" hidden>
+  <p id="summary"></p>
+  <pre id="result"></pre>
+  <ol id="matches"></ol>
+</section>
+<textarea id="curl" readonly tabindex="-1" aria-hidden="true"></textarea>
+<script src="/ui/app.js"></script>
+</body>
+</html>
+`
+
+const uiStyle = `body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; }
+form label { display: block; margin-bottom: .8em; }
+form input { width: 100%; box-sizing: border-box; padding: .4em; font-family: monospace; }
+form select { margin-bottom: .3em; }
+.actions button { padding: .4em 1em; }
+#summary.error { color: #b00020; }
+pre { background: #f4f4f4; padding: .6em; white-space: pre-wrap; word-break: break-word; }
+#matches li { margin-bottom: 1em; }
+#matches code { display: block; color: #555; margin-bottom: .3em; }
+mark { background: #fff176; }
+#curl { position: absolute; left: -9999px; }
+`
+
+const uiScript = `(function () {
+  "use strict";
+
+  var form = document.getElementById("query");
+  var url = document.getElementById("url");
+  var mode = document.getElementById("mode");
+  var expr = document.getElementById("expr");
+  var key = document.getElementById("key");
+
+  function params() {
+    var p = new URLSearchParams();
+    p.set("url", url.value);
+    p.set(mode.value, expr.value);
+    return p;
+  }
+
+  function headers() {
+    return key.value ? { "X-API-Key": key.value } : {};
+  }
+
+  function shellQuote(s) {
+    return "'" + s.replace(/'/g, "'\\''") + "'";
+  }
+
+  function curlCommand() {
+    var cmd = "curl -G " + shellQuote(location.origin + "/get");
+    params().forEach(function (value, name) {
+      cmd += " --data-urlencode " + shellQuote(name + "=" + value);
+    });
+    if (key.value) {
+      cmd += " -H " + shellQuote("X-API-Key: " + key.value);
+    }
+    return cmd;
+  }
+
+  function element(name, text) {
+    var e = document.createElement(name);
+    if (text !== undefined) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  // highlighted shows the markup around a match with the match marked. The
+  // offset of the match is in bytes of UTF-8.
+  function highlighted(m) {
+    var pre = element("pre");
+    var context = new TextEncoder().encode(m.context);
+    var end = m.offset + new TextEncoder().encode(m.html).length;
+    if (m.html === "" || end > context.length) {
+      pre.textContent = m.context;
+      return pre;
+    }
+    var decoder = new TextDecoder();
+    pre.appendChild(document.createTextNode(decoder.decode(context.subarray(0, m.offset))));
+    pre.appendChild(element("mark", m.html));
+    pre.appendChild(document.createTextNode(decoder.decode(context.subarray(end))));
+    return pre;
+  }
+
+  // explained tells how far an XPath that selects nothing got.
+  function explained(ex) {
+    if (!ex) {
+      return "";
+    }
+    var lines = ex.steps.map(function (s) {
+      return s.matches + "\t" + s.xpath +
+        (s.without_predicates !== undefined ? "  (" + s.without_predicates + " without predicates)" : "");
+    });
+    if (ex.elements) {
+      lines.push("Elements there: " + ex.elements.join(", "));
+    }
+    if (ex.classes) {
+      lines.push("Classes there: " + ex.classes.join(", "));
+    }
+    return lines.join("\n");
+  }
+
+  function show(res) {
+    var summary = document.getElementById("summary");
+    var list = document.getElementById("matches");
+    document.getElementById("output").hidden = false;
+    list.textContent = "";
+
+    if (res.error) {
+      summary.className = "error";
+      summary.textContent = res.error + (res.error_code ? " (" + res.error_code + ")" : "");
+    } else {
+      summary.className = "";
+      var count = res.match_count || 0;
+      summary.textContent = count + (count === 1 ? " match" : " matches") +
+        (res.matches && count > res.matches.length ? ", showing the first " + res.matches.length : "");
+    }
+    document.getElementById("result").textContent = res.result || explained(res.explanation);
+
+    (res.matches || []).forEach(function (m) {
+      var item = element("li");
+      item.appendChild(element("code", m.path));
+      item.appendChild(highlighted(m));
+      list.appendChild(item);
+    });
+  }
+
+  form.addEventListener("submit", function (event) {
+    event.preventDefault();
+    var p = params();
+    p.set("matches", "true");
+    p.set("explain", "true");
+    fetch("/get?" + p.toString(), { headers: headers() })
+      .then(function (resp) { return resp.json(); })
+      .then(show)
+      .catch(function (e) { show({ error: String(e) }); });
+  });
+
+  document.getElementById("copy").addEventListener("click", function () {
+    var cmd = curlCommand();
+    var copied = document.getElementById("copied");
+    function done() {
+      copied.hidden = false;
+      setTimeout(function () { copied.hidden = true; }, 1500);
+    }
+    // The clipboard API is only available on secure origins.
+    function fallback() {
+      var area = document.getElementById("curl");
+      area.value = cmd;
+      area.select();
+      document.execCommand("copy");
+      done();
+    }
+    if (navigator.clipboard) {
+      navigator.clipboard.writeText(cmd).then(done, fallback);
+    } else {
+      fallback();
+    }
+  });
+})();
+`
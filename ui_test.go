@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUIHandler(t *testing.T) {
+	for path, contentType := range map[string]string{
+		"/":             "text/html; charset=utf-8",
+		"/ui/app.js":    "application/javascript; charset=utf-8",
+		"/ui/style.css": "text/css; charset=utf-8",
+	} {
+		recorder := httptest.NewRecorder()
+		uiHandler(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != 200 || recorder.Header().Get("Content-Type") != contentType || recorder.Body.Len() == 0 {
+			t.Errorf("Got %d %s for %s", recorder.Code, recorder.Header().Get("Content-Type"), path)
+		}
+	}
+}
+
+func TestUIPageUsesGetAPI(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	uiHandler(recorder, httptest.NewRequest("GET", "/ui/app.js", nil))
+	if body := recorder.Body.String(); !strings.Contains(body, `"/get?"`) || !strings.Contains(body, `"matches", "true"`) {
+		t.Errorf("Got script %s", body)
+	}
+}
+
+func TestUIHandlerNotFound(t *testing.T) {
+	for _, path := range []string{"/index.html", "/ui/", "/ui/missing.js", "/app.js"} {
+		recorder := httptest.NewRecorder()
+		uiHandler(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != 404 {
+			t.Errorf("Got %d for %s", recorder.Code, path)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	uiHandler(recorder, httptest.NewRequest("POST", "/", nil))
+	if recorder.Code != 405 {
+		t.Errorf("Got %d for POST", recorder.Code)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+/*
+#cgo pkg-config: libxml-2.0
+#include <stdlib.h>
+#include <libxml/xpath.h>
+#include <libxml/xpathInternals.h>
+
+xmlXPathObjectPtr resolveXpathVariable(void *scope, xmlChar *name, xmlChar *ns);
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/moovweb/gokogiri/html"
+	"github.com/moovweb/gokogiri/xml"
+)
+
+// variablePrefix prefixes the parameters binding XPath variables, as in
+// var.name=value for $name.
+const variablePrefix = "var."
+
+// scopes holds the variables of the evaluations in progress, keyed by a C
+// allocated handle passed to libxml2. gokogiri's own resolver hands a Go
+// pointer to C, which the cgo pointer checks reject.
+var scopes = struct {
+	sync.Mutex
+	vars map[unsafe.Pointer]map[string]interface{}
+}{vars: make(map[unsafe.Pointer]map[string]interface{})}
+
+// searchNodes evaluates the compiled xpath on doc with its variables bound
+// to vars. The caller must hold the document's search lock.
+func searchNodes(doc *html.HtmlDocument, xpath string, vars map[string]interface{}) ([]xml.Node, error) {
+	x, e := expressions.acquire(xpath)
+	if e != nil {
+		return nil, e
+	}
+	defer expressions.release(x)
+	return searchCompiled(doc, x, vars)
+}
+
+// searchUncached is searchNodes for XPaths evaluated once, like the prefixes
+// explain tries. They are compiled outside the expression cache so that
+// they do not evict the expressions of queries.
+func searchUncached(doc *html.HtmlDocument, xpath string, vars map[string]interface{}) ([]xml.Node, error) {
+	x, e := compileXpath(xpath)
+	if e != nil {
+		return nil, e
+	}
+	defer x.expr.Free()
+	return searchCompiled(doc, x, vars)
+}
+
+func searchCompiled(doc *html.HtmlDocument, x *compiledXpath, vars map[string]interface{}) ([]xml.Node, error) {
+	var nodes []xml.Node
+	e := evaluateCompiled(doc, x, vars, func(x *compiledXpath) error {
+		var e error
+		nodes, e = doc.Root().Search(x.expr)
+		return e
+	})
+	return nodes, e
+}
+
+// evaluate calls eval with xpath compiled from the expression cache while
+// the variables of vars are bound on the XPath context of doc.
+func evaluate(doc *html.HtmlDocument, xpath string, vars map[string]interface{}, eval func(*compiledXpath) error) error {
+	x, e := expressions.acquire(xpath)
+	if e != nil {
+		return e
+	}
+	defer expressions.release(x)
+	return evaluateCompiled(doc, x, vars, eval)
+}
+
+func evaluateCompiled(doc *html.HtmlDocument, x *compiledXpath, vars map[string]interface{}, eval func(*compiledXpath) error) error {
+	if e := checkVariables(x.xpath, vars); e != nil {
+		return e
+	}
+	if len(vars) == 0 {
+		return eval(x)
+	}
+
+	scope := C.malloc(1)
+	scopes.Lock()
+	scopes.vars[scope] = vars
+	scopes.Unlock()
+
+	ctxt := (*C.xmlXPathContext)(unsafe.Pointer(doc.DocXPathCtx().ContextPtr))
+	ctxt.varLookupFunc = C.xmlXPathVariableLookupFunc(C.resolveXpathVariable)
+	ctxt.varLookupData = scope
+	defer func() {
+		ctxt.varLookupFunc = nil
+		ctxt.varLookupData = nil
+		scopes.Lock()
+		delete(scopes.vars, scope)
+		scopes.Unlock()
+		C.free(scope)
+	}()
+
+	return eval(x)
+}
+
+//export resolveXpathVariable
+func resolveXpathVariable(scope unsafe.Pointer, name *C.xmlChar, ns *C.xmlChar) C.xmlXPathObjectPtr {
+	if ns != nil {
+		return nil
+	}
+	scopes.Lock()
+	value, ok := scopes.vars[scope][C.GoString((*C.char)(unsafe.Pointer(name)))]
+	scopes.Unlock()
+	if !ok {
+		return nil
+	}
+
+	switch v := value.(type) {
+	case string:
+		s := C.CString(v)
+		defer C.free(unsafe.Pointer(s))
+		return C.xmlXPathNewString((*C.xmlChar)(unsafe.Pointer(s)))
+	case float64:
+		return C.xmlXPathNewFloat(C.double(v))
+	case bool:
+		if v {
+			return C.xmlXPathNewBoolean(1)
+		}
+		return C.xmlXPathNewBoolean(0)
+	}
+	return nil
+}
+
+// checkVariables makes sure every variable xpath references is bound to a
+// string, number or boolean.
+func checkVariables(xpath string, vars map[string]interface{}) error {
+	for name, value := range vars {
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return &queryError{Code: "invalid_variable", Message: fmt.Sprintf("XPath variable $%s must be a string, number or boolean.", name)}
+		}
+	}
+	for _, name := range referencedVariables(xpath) {
+		if strings.Contains(name, ":") {
+			return &queryError{Code: "invalid_variable", Message: fmt.Sprintf("XPath variable $%s has a namespace prefix, which is not supported.", name)}
+		}
+		if _, ok := vars[name]; !ok {
+			return &queryError{Code: "undefined_variable", Message: fmt.Sprintf("XPath variable $%s is not bound, pass it as %s%s.", name, variablePrefix, name)}
+		}
+	}
+	return nil
+}
+
+// referencedVariables returns the names of the variables in xpath, ignoring
+// string literals. Prefixed names like ns:name are returned whole.
+func referencedVariables(xpath string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	quote := byte(0)
+	for i := 0; i < len(xpath); i++ {
+		switch c := xpath[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '$':
+			end := scanVariableName(xpath, i+1)
+			if end > i+1 && end+1 < len(xpath) && xpath[end] == ':' && isVariableNameByte(xpath[end+1]) {
+				end = scanVariableName(xpath, end+1)
+			}
+			if name := xpath[i+1 : end]; name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			i = end - 1
+		}
+	}
+	return names
+}
+
+// scanVariableName returns the end of the name starting at start.
+func scanVariableName(xpath string, start int) int {
+	end := start
+	for end < len(xpath) && isVariableNameByte(xpath[end]) {
+		end++
+	}
+	return end
+}
+
+func isVariableName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if !isVariableNameByte(name[i]) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isVariableNameByte(c byte) bool {
+	return c == '-' || c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// variablesFlag collects -var name=value flags.
+type variablesFlag map[string]interface{}
+
+func (v variablesFlag) String() string {
+	var pairs []string
+	for name, value := range v {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v variablesFlag) Set(pair string) error {
+	i := strings.IndexByte(pair, '=')
+	if i < 1 {
+		return fmt.Errorf("expected name=value")
+	}
+	v[pair[:i]] = pair[i+1:]
+	return nil
+}
+
+// parseVariables reads the XPath variables of a query from the vars
+// parameter, a JSON object, and from var.<name> parameters, which take
+// precedence.
+func parseVariables(values neturl.Values) (map[string]interface{}, error) {
+	var vars map[string]interface{}
+	if v := values.Get("vars"); v != "" {
+		if e := json.Unmarshal([]byte(v), &vars); e != nil {
+			return nil, fmt.Errorf("vars must be a JSON object: %v", e)
+		}
+	}
+	for param := range values {
+		if !strings.HasPrefix(param, variablePrefix) || len(param) == len(variablePrefix) {
+			continue
+		}
+		if vars == nil {
+			vars = make(map[string]interface{})
+		}
+		vars[strings.TrimPrefix(param, variablePrefix)] = values.Get(param)
+	}
+	return vars, nil
+}
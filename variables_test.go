@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const variablesTestPage = `<html><body>
+<ul><li data-sku="A-1">Espresso</li><li data-sku="B'2&quot;">Grinder</li><li data-sku="C-3">Kettle</li></ul>
+</body></html>`
+
+func searchWithVariables(t *testing.T, xpath string, vars map[string]interface{}) (string, error) {
+	doc, e := parseHtml([]byte(variablesTestPage))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer doc.Free()
+	return searchXpath(doc, xpath, vars)
+}
+
+func TestSearchWithVariables(t *testing.T) {
+	for _, test := range []struct {
+		xpath    string
+		vars     map[string]interface{}
+		expected string
+	}{
+		{"//li[@data-sku=$sku]", map[string]interface{}{"sku": "C-3"}, "Kettle"},
+		// Quotes in values cannot break out of the expression.
+		{"//li[@data-sku=$sku]", map[string]interface{}{"sku": `B'2"`}, "Grinder"},
+		{"//li[$n]", map[string]interface{}{"n": 2.0}, "Grinder"},
+		{"//li[$all or @data-sku='A-1'][last()]", map[string]interface{}{"all": true}, "Kettle"},
+		{"//li[@data-sku='$sku']|//li[1]", nil, "Espresso"},
+	} {
+		if actual, e := searchWithVariables(t, test.xpath, test.vars); e != nil || actual != test.expected {
+			t.Errorf("Got '%s' (%v) for %s with %v, wanted '%s'", actual, e, test.xpath, test.vars, test.expected)
+		}
+	}
+}
+
+func TestSearchWithUnboundVariable(t *testing.T) {
+	_, e := searchWithVariables(t, "//li[@data-sku=$sku]", map[string]interface{}{"other": "x"})
+	if errorCode(e) != "undefined_variable" || !strings.Contains(e.Error(), "var.sku") {
+		t.Errorf("Got %v", e)
+	}
+	_, e = searchWithVariables(t, "//li[$sku]", map[string]interface{}{"sku": []interface{}{1}})
+	if errorCode(e) != "invalid_variable" {
+		t.Errorf("Got %v", e)
+	}
+}
+
+func TestConcurrentSearchesKeepTheirVariables(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc, _ := parseHtml([]byte(variablesTestPage))
+			defer doc.Free()
+			expected := []string{"Espresso", "Grinder", "Kettle"}[i%3]
+			if actual, e := searchXpath(doc, "//li[$n]", map[string]interface{}{"n": float64(i%3 + 1)}); actual != expected {
+				t.Errorf("Got '%s' (%v), wanted '%s'", actual, e, expected)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReferencedVariables(t *testing.T) {
+	names := referencedVariables(`//a[@x=$a and @y="$b"][$c-1 = $a]`)
+	if !reflect.DeepEqual(names, []string{"a", "c-1"}) {
+		t.Errorf("Got %q", names)
+	}
+	if names := referencedVariables(`//a[@x=$ns:sku][$b:c = 1]`); !reflect.DeepEqual(names, []string{"ns:sku", "b:c"}) {
+		t.Errorf("Got %q", names)
+	}
+}
+
+func TestPrefixedVariablesAreRejected(t *testing.T) {
+	e := checkVariables(`//a[@x=$ns:sku]`, map[string]interface{}{"ns": "x", "sku": "y"})
+	if errorCode(e) != "invalid_variable" {
+		t.Errorf("Got %v, wanted invalid_variable", e)
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	vars, e := parseVariables(neturl.Values{"vars": {`{"a": "x", "n": 2}`}, "var.a": {"y"}, "var.": {"z"}, "xpath": {"//a"}})
+	if e != nil || !reflect.DeepEqual(vars, map[string]interface{}{"a": "y", "n": 2.0}) {
+		t.Errorf("Got %v %v", vars, e)
+	}
+	if _, e := parseVariables(neturl.Values{"vars": {"[1]"}}); e == nil {
+		t.Error("Expected an error for vars that are not an object")
+	}
+}
+
+func TestGetWithVariables(t *testing.T) {
+	defer allowLoopback()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, variablesTestPage)
+	}))
+	defer server.Close()
+
+	for params, expected := range map[string]string{
+		"xpath=//li[@data-sku=$sku]&var.sku=A-1":                `"result":"Espresso"`,
+		"xpath=//li[$n]&vars=" + neturl.QueryEscape(`{"n": 3}`): `"result":"Kettle"`,
+		"xpath=//li[@data-sku=$sku]":                            `"error_code":"undefined_variable"`,
+	} {
+		recorder := httptest.NewRecorder()
+		requestHandler(recorder, httptest.NewRequest("GET", "/get?url="+neturl.QueryEscape(server.URL)+"&"+params, nil))
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("Got %s for %s", recorder.Body.String(), params)
+		}
+	}
+
+	body := fmt.Sprintf(`{"url": %q, "xpath": "//li[@data-sku=$sku]", "vars": {"sku": "C-3"}}`, server.URL)
+	recorder := httptest.NewRecorder()
+	requestHandler(recorder, newPostRequest("application/json", body))
+	var res result
+	if json.Unmarshal(recorder.Body.Bytes(), &res); res.Result != "Kettle" {
+		t.Errorf("Got %s", recorder.Body.String())
+	}
+}
+
+func TestGetCommandWithVariables(t *testing.T) {
+	defer saveSettings()()
+	server := newCLITestServer()
+	defer server.Close()
+
+	code, stdout, stderr := runTestCommand("get", "-var", "name=title", server.URL, "//*[name()=$name]")
+	if code != exitOK || stdout != "Cached Page\n" {
+		t.Errorf("Got exit code %d and output '%s' (%s)", code, stdout, stderr)
+	}
+}